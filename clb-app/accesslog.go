@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLog configures the one-line-per-request access log.
+type AccessLog struct {
+	Output     string  `json:"output"`      // "stdout", "stderr", "off" or a file path
+	Format     string  `json:"format"`      // json or text (logfmt-style key=value pairs)
+	SampleRate float64 `json:"sample_rate"` // share of requests logged; 5xx responses are always logged
+	MaxSize    int64   `json:"max_size"`    // bytes after which a file is rotated, 0 never rotates
+	MaxBackups int     `json:"max_backups"` // rotated files kept as path.1, path.2, ...; 0 keeps none
+}
+
+func (al *AccessLog) setDefaults() {
+	al.Output = "stdout"
+	al.Format = "json"
+	al.SampleRate = 1
+	al.MaxSize = 100 << 20
+	al.MaxBackups = 3
+}
+
+// applyEnv applies the ACCESS_LOG and ACCESS_LOG_* overrides.
+func (al *AccessLog) applyEnv() error {
+	al.Output = envOr("ACCESS_LOG", al.Output)
+	al.Format = envOr("ACCESS_LOG_FORMAT", al.Format)
+	var err error
+	if al.SampleRate, err = envFloat("ACCESS_LOG_SAMPLE_RATE", al.SampleRate); err != nil {
+		return err
+	}
+	if al.MaxSize, err = envSize("ACCESS_LOG_MAX_SIZE", al.MaxSize); err != nil {
+		return err
+	}
+	if al.MaxBackups, err = envNonNegInt("ACCESS_LOG_MAX_BACKUPS", al.MaxBackups); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (al *AccessLog) validate(v *validator, path string) {
+	if al.Output == "" {
+		v.errorf(path+".output", "is required; use \"off\" to disable the access log")
+	}
+	if al.Format != "json" && al.Format != "text" {
+		v.errorf(path+".format", "unknown format %q, want json or text", al.Format)
+	}
+	if al.SampleRate < 0 || al.SampleRate > 1 {
+		v.errorf(path+".sample_rate", "must be between 0 and 1, got %v", al.SampleRate)
+	}
+	if al.MaxSize < 0 {
+		v.errorf(path+".max_size", "must not be negative")
+	}
+	if al.MaxBackups < 0 {
+		v.errorf(path+".max_backups", "must not be negative")
+	}
+}
+
+// accessLogger writes access log entries; a nil *accessLogger logs nothing.
+type accessLogger struct {
+	cfg AccessLog
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newAccessLogger(cfg AccessLog) (*accessLogger, error) {
+	l := &accessLogger{cfg: cfg}
+	switch cfg.Output {
+	case "off":
+		return nil, nil
+	case "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := openRotatingFile(cfg.Output, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+// accessEntry is one access log line.
+type accessEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Client     string  `json:"client"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	Pool       string  `json:"pool"`
+	Backend    string  `json:"backend"`
+	Attempts   int     `json:"attempts"`
+	UpstreamMs float64 `json:"upstream_ms"` // waiting for response headers, over all attempts
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// log writes e unless it is sampled out.
+func (l *accessLogger) log(e *accessEntry) {
+	if l == nil || (e.Status < 500 && rand.Float64() >= l.cfg.SampleRate) {
+		return
+	}
+	var line []byte
+	if l.cfg.Format == "json" {
+		line, _ = json.Marshal(e)
+	} else {
+		line = []byte(e.text())
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+func (e *accessEntry) text() string {
+	var b strings.Builder
+	for i, f := range []struct{ k, v string }{
+		{"time", e.Time},
+		{"request_id", e.RequestID},
+		{"client", e.Client},
+		{"method", e.Method},
+		{"host", e.Host},
+		{"path", e.Path},
+		{"status", strconv.Itoa(e.Status)},
+		{"bytes_in", strconv.FormatInt(e.BytesIn, 10)},
+		{"bytes_out", strconv.FormatInt(e.BytesOut, 10)},
+		{"pool", e.Pool},
+		{"backend", e.Backend},
+		{"attempts", strconv.Itoa(e.Attempts)},
+		{"upstream_ms", strconv.FormatFloat(e.UpstreamMs, 'f', 3, 64)},
+		{"duration_ms", strconv.FormatFloat(e.DurationMs, 'f', 3, 64)},
+	} {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.k)
+		b.WriteByte('=')
+		if f.v == "" || strings.ContainsAny(f.v, " \"=\\") {
+			b.WriteString(strconv.Quote(f.v))
+		} else {
+			b.WriteString(f.v)
+		}
+	}
+	return b.String()
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1 once it
+// grows past maxSize, shifting older backups up and dropping the oldest.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past maxSize. The
+// caller serializes writes.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	if rf.maxBackups == 0 {
+		os.Remove(rf.path)
+	}
+	for i := rf.maxBackups; i > 0; i-- {
+		src := rf.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", rf.path, i-1)
+		}
+		os.Rename(src, fmt.Sprintf("%s.%d", rf.path, i))
+	}
+	return rf.open()
+}
+
+// countingReader counts the bytes read from a request body. The transport
+// may still be reading it after the response has arrived, so the count is
+// kept atomically.
+type countingReader struct {
+	io.ReadCloser
+	n int64 // accessed atomically
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes read so far.
+func (cr *countingReader) count() int64 {
+	return atomic.LoadInt64(&cr.n)
+}
+
+// newAccessEntry fills in what is known about r when it completes.
+func newAccessEntry(r *http.Request, start time.Time, status int, ex *exchange) *accessEntry {
+	e := &accessEntry{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		RequestID:  r.Header.Get(requestIDHeader),
+		Client:     r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Status:     status,
+		Attempts:   ex.attempts,
+		UpstreamMs: float64(ex.upstream) / float64(time.Millisecond),
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if ex.pool != nil {
+		e.Pool = ex.pool.name
+	}
+	if ex.backend != nil {
+		e.Backend = ex.backend.Addr
+	}
+	return e
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCountingReaderConcurrentCount reads the count while another goroutine
+// reads the body, as the access log does when the transport is still sending
+// a body the backend answered early. Run with -race.
+func TestCountingReaderConcurrentCount(t *testing.T) {
+	cr := &countingReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", 1000)))}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 10)
+		for {
+			if _, err := cr.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(time.Microsecond)
+		}
+	}()
+	for cr.count() < 1000 {
+		time.Sleep(time.Microsecond)
+	}
+	<-done
+	if got := cr.count(); got != 1000 {
+		t.Errorf("counted %d bytes, want 1000", got)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// adminAPI serves /api/v1 on the admin listener:
+//
+//	GET    /api/v1/pools                          list pools and their backends
+//	GET    /api/v1/pools/{pool}                   one pool
+//	POST   /api/v1/pools/{pool}/backends          add a backend: {"address": ..., "weight": ...}
+//	GET    /api/v1/pools/{pool}/backends/{addr}   one backend
+//	PATCH  /api/v1/pools/{pool}/backends/{addr}   {"weight": ...} and/or {"state": "active"|"disabled"|"draining"}
+//	DELETE /api/v1/pools/{pool}/backends/{addr}   remove a backend
+//	GET    /api/v1/splits                         list traffic splits and their shares
+//	GET    /api/v1/splits/{split}                 one split
+//	PATCH  /api/v1/splits/{split}                 {"weights": {"pool": weight, ...}}
+//	POST   /api/v1/splits/{split}/shift           move traffic: {"pool": ..., "percent": 10}
+//
+// Every request needs "Authorization: Bearer <token>". Changes take effect
+// immediately, are not persisted, and are written to the audit log.
+type adminAPI struct {
+	tokens map[string]string // token to the name recorded in the audit log
+
+	auditMu sync.Mutex
+	audit   io.Writer // nil writes audit entries to the process log
+}
+
+func newAdminAPI(cfg AdminConfig) (*adminAPI, error) {
+	api := &adminAPI{tokens: make(map[string]string)}
+	if t := os.Getenv("ADMIN_TOKEN"); t != "" {
+		api.tokens[t] = "admin"
+	}
+	if cfg.TokenFile != "" {
+		if err := api.loadTokens(cfg.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(api.tokens) == 0 {
+		return nil, nil
+	}
+	if cfg.AuditLog != "" {
+		f, err := openRotatingFile(cfg.AuditLog, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		api.audit = f
+	}
+	return api, nil
+}
+
+func (api *adminAPI) loadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token := "admin", line
+		if i := strings.Index(line, ":"); i >= 0 {
+			name, token = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		if token == "" {
+			return fmt.Errorf("%s:%d: empty token", path, n)
+		}
+		api.tokens[token] = name
+	}
+	return sc.Err()
+}
+
+// authenticate returns the name of the caller's token, or "" if the request
+// does not carry a valid one.
+func (api *adminAPI) authenticate(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	given := []byte(strings.TrimSpace(h[len("Bearer "):]))
+	name := ""
+	for token, n := range api.tokens {
+		// Compare against every token so timing does not reveal which
+		// prefix matched.
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			name = n
+		}
+	}
+	return name
+}
+
+func (api *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := api.authenticate(r)
+	if user == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="clb-app admin"`)
+		writeAPIError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1"), "/"), "/")
+	for i, p := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(p); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid path")
+			return
+		}
+	}
+	if parts[0] == "splits" {
+		api.serveSplits(w, r, user, parts[1:])
+		return
+	}
+	if parts[0] != "pools" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 1 {
+		api.listPools(w, r)
+		return
+	}
+	pool := pools[parts[1]]
+	if pool == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no pool %q", parts[1]))
+		return
+	}
+	switch {
+	case len(parts) == 2:
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, newPoolView(pool))
+	case len(parts) == 3 && parts[2] == "backends":
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, newPoolView(pool).Backends)
+			return
+		}
+		api.addBackend(w, r, user, pool)
+	case len(parts) == 4 && parts[2] == "backends":
+		b := pool.Lookup(parts[3])
+		if b == nil {
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no backend %q in pool %s", parts[3], pool.name))
+			return
+		}
+		if !allowMethods(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete) {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, newBackendView(pool, b))
+		case http.MethodPatch:
+			api.changeBackend(w, r, user, pool, b)
+		case http.MethodDelete:
+			if pool.Remove(b.Addr) {
+				api.record(r, user, auditEntry{Action: "remove", Pool: pool.name, Backend: b.Addr})
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (api *adminAPI) listPools(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	views := make([]poolView, 0, len(names))
+	for _, name := range names {
+		views = append(views, newPoolView(pools[name]))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (api *adminAPI) addBackend(w http.ResponseWriter, r *http.Request, user string, pool *Pool) {
+	var req struct {
+		Address string   `json:"address"`
+		Weight  *float64 `json:"weight"`
+		Zone    string   `json:"zone"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	b := &Backend{Addr: req.Address, Weight: 1, Zone: req.Zone}
+	if req.Weight != nil {
+		b.Weight = *req.Weight
+	}
+	if b.Addr == "" {
+		writeAPIError(w, http.StatusBadRequest, "address is required")
+		return
+	}
+	if host, port, err := net.SplitHostPort(b.Addr); err != nil || host == "" || port == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("address must be host:port, got %q", b.Addr))
+		return
+	}
+	if !validWeight(b.Weight) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("weight must be a non-negative number, got %v", b.Weight))
+		return
+	}
+	if err := pool.Add(b); err != nil {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.record(r, user, auditEntry{Action: "add", Pool: pool.name, Backend: b.Addr,
+		Detail: map[string]interface{}{"weight": pool.Weight(b)}})
+	writeJSON(w, http.StatusCreated, newBackendView(pool, b))
+}
+
+func (api *adminAPI) changeBackend(w http.ResponseWriter, r *http.Request, user string, pool *Pool, b *Backend) {
+	var req struct {
+		Weight *float64 `json:"weight"`
+		State  *string  `json:"state"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Weight == nil && req.State == nil {
+		writeAPIError(w, http.StatusBadRequest, "nothing to change: set weight and/or state")
+		return
+	}
+	if req.Weight != nil && !validWeight(*req.Weight) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("weight must be a non-negative number, got %v", *req.Weight))
+		return
+	}
+	if req.State != nil {
+		from := b.State()
+		if err := pool.SetState(b, *req.State); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		api.record(r, user, auditEntry{Action: "set_state", Pool: pool.name, Backend: b.Addr,
+			Detail: map[string]interface{}{"from": from, "to": *req.State}})
+	}
+	if req.Weight != nil {
+		from := pool.Weight(b)
+		pool.SetWeight(b, *req.Weight)
+		api.record(r, user, auditEntry{Action: "set_weight", Pool: pool.name, Backend: b.Addr,
+			Detail: map[string]interface{}{"from": from, "to": *req.Weight}})
+	}
+	writeJSON(w, http.StatusOK, newBackendView(pool, b))
+}
+
+// auditEntry is one change made through the API.
+type auditEntry struct {
+	Time    string                 `json:"time"`
+	User    string                 `json:"user"`
+	Remote  string                 `json:"remote"`
+	Action  string                 `json:"action"`
+	Pool    string                 `json:"pool,omitempty"`
+	Backend string                 `json:"backend,omitempty"`
+	Split   string                 `json:"split,omitempty"`
+	Detail  map[string]interface{} `json:"detail,omitempty"`
+}
+
+// record writes e to the audit log, filling in who made the change and when.
+func (api *adminAPI) record(r *http.Request, user string, e auditEntry) {
+	e.Time, e.User, e.Remote = time.Now().UTC().Format(time.RFC3339Nano), user, r.RemoteAddr
+	line, _ := json.Marshal(e)
+
+	api.auditMu.Lock()
+	defer api.auditMu.Unlock()
+	if api.audit == nil {
+		log.Printf("audit: %s", line)
+		return
+	}
+	api.audit.Write(append(line, '\n'))
+}
+
+func (api *adminAPI) serveSplits(w http.ResponseWriter, r *http.Request, user string, parts []string) {
+	splits := currentRouter.Load().(*Router).splits
+	if len(parts) == 0 {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		names := make([]string, 0, len(splits))
+		for name := range splits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		views := make([]splitView, 0, len(names))
+		for _, name := range names {
+			views = append(views, newSplitView(splits[name]))
+		}
+		writeJSON(w, http.StatusOK, views)
+		return
+	}
+	split := splits[parts[0]]
+	if split == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no split %q", parts[0]))
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var req struct {
+				Weights map[string]float64 `json:"weights"`
+			}
+			if !readJSON(w, r, &req) {
+				return
+			}
+			from := split.Weights()
+			if err := split.SetWeights(req.Weights); err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			api.record(r, user, auditEntry{Action: "set_split_weights", Split: split.name,
+				Detail: map[string]interface{}{"from": from, "to": split.Weights()}})
+		}
+		writeJSON(w, http.StatusOK, newSplitView(split))
+	case len(parts) == 2 && parts[1] == "shift":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		var req struct {
+			Pool    string  `json:"pool"`
+			Percent float64 `json:"percent"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		from := split.Weights()
+		to, err := split.Shift(req.Pool, req.Percent)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		api.record(r, user, auditEntry{Action: "shift_split", Split: split.name,
+			Detail: map[string]interface{}{"pool": req.Pool, "percent": req.Percent, "from": from, "to": to}})
+		writeJSON(w, http.StatusOK, newSplitView(split))
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+type splitView struct {
+	Name     string             `json:"name"`
+	Percent  map[string]float64 `json:"percent"`  // by pool
+	Adjusted bool               `json:"adjusted"` // set through the API, kept across reloads
+}
+
+func newSplitView(s *Split) splitView {
+	return splitView{Name: s.name, Percent: s.Weights(), Adjusted: s.Adjusted()}
+}
+
+type poolView struct {
+	Name     string        `json:"name"`
+	Strategy string        `json:"strategy"`
+	Backends []backendView `json:"backends"`
+}
+
+type backendView struct {
+	Address         string            `json:"address"`
+	Weight          float64           `json:"weight"`
+	EffectiveWeight float64           `json:"effective_weight"` // lower while slow-starting
+	Zone            string            `json:"zone,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	State           string            `json:"state"`
+	Healthy         bool              `json:"healthy"`
+	Ejected         bool              `json:"ejected"`
+	InFlight        int64             `json:"in_flight"`
+	ErrorRate       float64           `json:"error_rate"`      // over the last one to two minutes
+	RecentRequests  int               `json:"recent_requests"` // what error_rate is based on
+	Manual          bool              `json:"manual"`          // added through the API
+	WeightPinned    bool              `json:"weight_pinned"`   // set through the API
+}
+
+func newPoolView(p *Pool) poolView {
+	v := poolView{Name: p.name, Strategy: p.Strategy(), Backends: []backendView{}}
+	for _, b := range p.Backends() {
+		v.Backends = append(v.Backends, newBackendView(p, b))
+	}
+	return v
+}
+
+func newBackendView(p *Pool, b *Backend) backendView {
+	rate, requests := b.recent.errorRate()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return backendView{
+		Address:         b.Addr,
+		Weight:          b.Weight,
+		EffectiveWeight: b.effectiveWeight(),
+		Zone:            b.Zone,
+		Metadata:        b.Metadata,
+		State:           b.State(),
+		Healthy:         b.Healthy(),
+		Ejected:         b.Ejected(time.Now()),
+		InFlight:        atomic.LoadInt64(&b.inflight),
+		ErrorRate:       rate,
+		RecentRequests:  requests,
+		Manual:          b.manual,
+		WeightPinned:    b.weightPinned,
+	}
+}
+
+func validWeight(w float64) bool {
+	return !math.IsNaN(w) && !math.IsInf(w, 0) && w >= 0
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if containsString(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	return false
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAddBackendValidatesAddress(t *testing.T) {
+	defer func(prev map[string]*Pool) { pools = prev }(pools)
+	pool, _ := newPool("web", "round-robin")
+	pools = map[string]*Pool{"web": pool}
+	var audit bytes.Buffer
+	api := &adminAPI{tokens: map[string]string{"secret": "admin"}, audit: &audit}
+
+	for _, tt := range []struct {
+		addr   string
+		status int
+	}{
+		{"web-1", http.StatusBadRequest},
+		{"web-1:", http.StatusBadRequest},
+		{":8080", http.StatusBadRequest},
+		{"10.0.0.1:80:80", http.StatusBadRequest},
+		{"fd00::1:80", http.StatusBadRequest},
+		{"web-1:8080", http.StatusCreated},
+		{"[fd00::1]:80", http.StatusCreated},
+	} {
+		r := httptest.NewRequest("POST", "/api/v1/pools/web/backends", strings.NewReader(`{"address": "`+tt.addr+`"}`))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("adding %q: status %d, want %d", tt.addr, w.Code, tt.status)
+		}
+		if added := pool.Lookup(tt.addr) != nil; added != (tt.status == http.StatusCreated) {
+			t.Errorf("adding %q: in pool = %v", tt.addr, added)
+		}
+		if logged := strings.Contains(audit.String(), `"`+tt.addr+`"`); logged != (tt.status == http.StatusCreated) {
+			t.Errorf("adding %q: in audit log = %v", tt.addr, logged)
+		}
+	}
+}
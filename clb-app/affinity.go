@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Affinity keeps a client on the same backend across requests. In cookie
+// mode the balancer issues a signed cookie naming the backend; in source-ip
+// mode the client address is hashed onto the backends. Either way a client
+// whose backend is no longer selectable is balanced as usual, and in cookie
+// mode re-pinned to the new backend.
+type Affinity struct {
+	Mode       string        `json:"mode"` // "cookie" or "source-ip"
+	CookieName string        `json:"cookie_name"`
+	TTL        time.Duration `json:"ttl"`         // lifetime of an affinity cookie, renewed while in use
+	SecretFile string        `json:"secret_file"` // key for signing cookies; AFFINITY_SECRET or a random key otherwise
+
+	key []byte // set by loadKey
+}
+
+const (
+	affinityCookie   = "cookie"
+	affinitySourceIP = "source-ip"
+)
+
+func (a *Affinity) setDefaults() {
+	a.Mode = affinityCookie
+	a.CookieName = "clb_affinity"
+	a.TTL = time.Hour
+}
+
+// applyEnv applies the AFFINITY_* overrides.
+func (a *Affinity) applyEnv() error {
+	a.Mode = envOr("AFFINITY", a.Mode)
+	a.CookieName = envOr("AFFINITY_COOKIE_NAME", a.CookieName)
+	a.SecretFile = envOr("AFFINITY_SECRET_FILE", a.SecretFile)
+	var err error
+	if a.TTL, err = envDuration("AFFINITY_TTL", a.TTL); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Affinity) validate(v *validator, path string) {
+	if a.Mode != affinityCookie && a.Mode != affinitySourceIP {
+		v.errorf(path+".mode", "must be cookie or source-ip, got %q", a.Mode)
+	}
+	if a.Mode == affinityCookie {
+		if a.CookieName == "" || strings.ContainsAny(a.CookieName, " \t;,=\"") {
+			v.errorf(path+".cookie_name", "must be a valid cookie name, got %q", a.CookieName)
+		}
+		if a.TTL <= 0 {
+			v.errorf(path+".ttl", "must be positive")
+		}
+	}
+}
+
+// loadKey reads the cookie signing key. Without one a random key is used,
+// so cookies stop pinning on restart and are not honored by other replicas.
+func (a *Affinity) loadKey(pool string) error {
+	if a.Mode != affinityCookie {
+		return nil
+	}
+	secret := os.Getenv("AFFINITY_SECRET")
+	if a.SecretFile != "" {
+		data, err := os.ReadFile(a.SecretFile)
+		if err != nil {
+			return err
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if secret != "" {
+		a.key = []byte(secret)
+		return nil
+	}
+	log.Printf("pool %s: no affinity secret configured, cookies are only valid for this process", pool)
+	a.key = make([]byte, 32)
+	_, err := rand.Read(a.key)
+	return err
+}
+
+// choose returns the candidate r is pinned to, or nil if r carries no valid
+// pin to a selectable backend.
+func (a *Affinity) choose(r *http.Request, pool string, candidates []*Backend) *Backend {
+	if a.Mode == affinitySourceIP {
+		return hashChoice(clientAddr(r), candidates)
+	}
+	id, _, ok := a.readCookie(r, pool)
+	if !ok {
+		return nil
+	}
+	for _, b := range candidates {
+		if a.backendID(b) == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// pin sets a cookie pinning the client to b unless its current cookie
+// already does for at least half the TTL.
+func (a *Affinity) pin(w http.ResponseWriter, r *http.Request, pool string, b *Backend) {
+	if a == nil || a.Mode != affinityCookie {
+		return
+	}
+	if id, expires, ok := a.readCookie(r, pool); ok && id == a.backendID(b) && time.Until(expires) > a.TTL/2 {
+		return
+	}
+	expires := time.Now().Add(a.TTL).Unix()
+	id := a.backendID(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.CookieName,
+		Value:    id + "." + strconv.FormatInt(expires, 10) + "." + a.sign(pool, id, expires),
+		Path:     "/",
+		MaxAge:   int(a.TTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readCookie returns the backend ID and expiry in r's affinity cookie if it
+// is present, correctly signed for pool and not expired.
+func (a *Affinity) readCookie(r *http.Request, pool string) (id string, expires time.Time, ok bool) {
+	c, err := r.Cookie(a.CookieName)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[2]), []byte(a.sign(pool, parts[0], unix))) {
+		return "", time.Time{}, false
+	}
+	if expires = time.Unix(unix, 0); time.Now().After(expires) {
+		return "", time.Time{}, false
+	}
+	return parts[0], expires, true
+}
+
+// backendID identifies b in cookies without revealing its address.
+func (a *Affinity) backendID(b *Backend) string {
+	mac := hmac.New(sha256.New, a.key)
+	fmt.Fprintf(mac, "backend %s", b.Addr)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (a *Affinity) sign(pool, id string, expires int64) string {
+	mac := hmac.New(sha256.New, a.key)
+	fmt.Fprintf(mac, "%s %s %d", pool, id, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// clientAddr is the IP address r came from.
+func clientAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// hashChoice picks a candidate for key by weighted rendezvous hashing: the
+// same key maps to the same backend, and changing the backend set only moves
+// the keys of the backends that came or went. Configured weights are used
+// rather than slow-start ones so that the mapping stays put during a ramp.
+func hashChoice(key string, candidates []*Backend) *Backend {
+	var best *Backend
+	bestScore := math.Inf(-1)
+	for _, b := range candidates {
+		if b.Weight <= 0 {
+			continue
+		}
+		// Uniform in (0, 1), so the log is negative and finite.
+		u := (float64(hash64(key, b.Addr)>>11) + 0.5) / (1 << 53)
+		if score := -b.Weight / math.Log(u); score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
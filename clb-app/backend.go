@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is a single upstream pod the balancer can send requests to.
+//
+// Once b is in a pool, updates and the admin API change its Weight, Zone and
+// Metadata under the pool's lock; read them under it too, e.g. through
+// Pool.Weight.
+type Backend struct {
+	Addr     string
+	Weight   float64
+	Zone     string            // informational, from the config file
+	Metadata map[string]string // informational, from the config file
+
+	inflight     int64 // outstanding proxied requests, accessed atomically
+	ejectedUntil int64 // outlier ejection end in Unix nanoseconds, accessed atomically
+	unhealthy    int32 // set by active health checks, accessed atomically
+	state        int32 // backendActive, backendDisabled or backendDraining, accessed atomically
+	warmingSince int64 // slow-start ramp start in Unix nanoseconds, accessed atomically
+
+	slowStart *SlowStart // the pool's, set before b joins it; nil disables ramping
+
+	// Set through the admin API and guarded by the pool's lock: a pinned
+	// weight is no longer changed by discovery or reloads, and a manual
+	// backend is kept when discovery no longer reports it.
+	weightPinned bool
+	manual       bool
+
+	drainStarted int64 // drain start in Unix nanoseconds, accessed atomically
+	// Whether a draining backend leaves the pool once drained, which is the
+	// case when discovery dropped it rather than an operator draining it.
+	// Guarded by the pool's lock.
+	drainRemove bool
+
+	// Consecutive active check results, owned by the health checker.
+	checkSuccesses int
+	checkFailures  int
+
+	outlier outlierStats
+	recent  resultWindow
+}
+
+// Administrative backend states. Only active backends receive new requests.
+const (
+	backendActive int32 = iota
+	backendDisabled
+	backendDraining
+)
+
+var backendStateNames = []string{"active", "disabled", "draining"}
+
+// parseBackends reads the backend list from POD_IPS-style input. Each entry is
+// an address optionally followed by "=weight", e.g. "10.0.0.1=5,10.0.0.2=3".
+// Weights may instead be given as a separate comma-separated list, in which
+// case it must have one entry per address. Backends without any weight get 1.
+func parseBackends(podIPs, podWeights string) ([]*Backend, error) {
+	var backends []*Backend
+	inline := 0
+	for _, entry := range strings.Split(podIPs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		b := &Backend{Addr: entry, Weight: 1}
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			w, err := parseWeight(entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %v", entry, err)
+			}
+			b.Addr, b.Weight = strings.TrimSpace(entry[:i]), w
+			inline++
+		}
+		backends = append(backends, b)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	if inline > 0 && inline != len(backends) {
+		return nil, fmt.Errorf("weights given for %d of %d backends", inline, len(backends))
+	}
+
+	if podWeights = strings.TrimSpace(podWeights); podWeights != "" {
+		if inline > 0 {
+			return nil, fmt.Errorf("weights given both inline and as a separate list")
+		}
+		weights := strings.Split(podWeights, ",")
+		if len(weights) != len(backends) {
+			return nil, fmt.Errorf("got %d weights for %d backends", len(weights), len(backends))
+		}
+		for i, s := range weights {
+			w, err := parseWeight(s)
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %v", backends[i].Addr, err)
+			}
+			backends[i].Weight = w
+		}
+	}
+
+	if err := validateBackends(backends); err != nil {
+		return nil, err
+	}
+	return backends, nil
+}
+
+func parseWeight(s string) (float64, error) {
+	w, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid weight %q", s)
+	}
+	return w, nil
+}
+
+// validateBackends checks that a backend set can be balanced over.
+func validateBackends(backends []*Backend) error {
+	seen := make(map[string]bool, len(backends))
+	total := 0.0
+	for _, b := range backends {
+		if b.Addr == "" {
+			return fmt.Errorf("backend with empty address")
+		}
+		if seen[b.Addr] {
+			return fmt.Errorf("backend %q listed more than once", b.Addr)
+		}
+		seen[b.Addr] = true
+		if math.IsNaN(b.Weight) || math.IsInf(b.Weight, 0) || b.Weight < 0 {
+			return fmt.Errorf("backend %q: weight must be a non-negative number, got %v", b.Addr, b.Weight)
+		}
+		total += b.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("total backend weight is zero")
+	}
+	return nil
+}
+
+// acquire marks the start of a proxied request to b and returns the function
+// that marks its end.
+func (b *Backend) acquire() (release func()) {
+	atomic.AddInt64(&b.inflight, 1)
+	return func() { atomic.AddInt64(&b.inflight, -1) }
+}
+
+// Healthy reports whether b may be selected for new requests.
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+func (b *Backend) setHealthy(healthy bool) {
+	v := int32(1)
+	if healthy {
+		v = 0
+	}
+	atomic.StoreInt32(&b.unhealthy, v)
+}
+
+// State returns b's administrative state as "active", "disabled" or
+// "draining".
+func (b *Backend) State() string {
+	return backendStateNames[atomic.LoadInt32(&b.state)]
+}
+
+func parseBackendState(name string) (int32, error) {
+	for i, n := range backendStateNames {
+		if n == name {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backend state %q, want active, disabled or draining", name)
+}
+
+// Draining reports whether b is waiting for its in-flight requests to finish.
+func (b *Backend) Draining() bool {
+	return atomic.LoadInt32(&b.state) == backendDraining
+}
+
+// drainingFor returns how long b has been draining, or 0.
+func (b *Backend) drainingFor(now time.Time) time.Duration {
+	if !b.Draining() {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&b.drainStarted)))
+}
+
+// resultWindow counts request outcomes over the current and the previous
+// minute.
+type resultWindow struct {
+	mu       sync.Mutex
+	start    time.Time // start of the current minute
+	requests [2]int    // current, previous
+	failures [2]int
+}
+
+func (w *resultWindow) advance(now time.Time) {
+	switch elapsed := now.Sub(w.start); {
+	case elapsed < time.Minute:
+		return
+	case elapsed < 2*time.Minute:
+		w.requests[1], w.failures[1] = w.requests[0], w.failures[0]
+	default:
+		w.requests[1], w.failures[1] = 0, 0
+	}
+	w.requests[0], w.failures[0] = 0, 0
+	w.start = now.Truncate(time.Minute)
+}
+
+func (w *resultWindow) record(failed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(time.Now())
+	w.requests[0]++
+	if failed {
+		w.failures[0]++
+	}
+}
+
+// errorRate returns the share of failed requests over the last one to two
+// minutes and the number of requests it is based on.
+func (w *resultWindow) errorRate() (rate float64, requests int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(time.Now())
+	requests = w.requests[0] + w.requests[1]
+	if requests == 0 {
+		return 0, 0
+	}
+	return float64(w.failures[0]+w.failures[1]) / float64(requests), requests
+}
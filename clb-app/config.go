@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config is the complete balancer configuration. It is read from the YAML or
+// JSON file named by -config or CONFIG_FILE, if any, and the environment
+// variables documented on each section override the file; see
+// config.schema.json and config.example.yaml.
+//
+// Pool strategies and hash keys, static backends and routes are reloaded
+// while running. Everything else takes effect on restart.
+type Config struct {
+	Listeners      []ListenerConfig `json:"listeners"`
+	Admin          AdminConfig      `json:"admin"`
+	Strategy       string           `json:"strategy"` // default for pools without one
+	Pools          []*PoolConfig    `json:"pools"`
+	Routes         []*RouteConfig   `json:"routes"`
+	Splits         []*SplitConfig   `json:"splits"`
+	DefaultPool    string           `json:"default_pool"` // for requests no route matches
+	Timeouts       Timeouts         `json:"timeouts"`
+	Retries        RetryPolicy      `json:"retries"`
+	Streaming      Streaming        `json:"streaming"`
+	Shutdown       Shutdown         `json:"shutdown"`
+	AccessLog      AccessLog        `json:"access_log"`
+	Tracing        Tracing          `json:"tracing"`
+	ReloadInterval time.Duration    `json:"reload_interval"`
+
+	lines map[string]int // line of each setting in the file, by path
+}
+
+// ListenerConfig is an address the balancer listens on.
+type ListenerConfig struct {
+	Address string `json:"address"`
+}
+
+// AdminConfig is the listener for probes, metrics and the admin API. The API
+// is only served when tokens are configured, in TokenFile or ADMIN_TOKEN.
+type AdminConfig struct {
+	Address   string `json:"address"`
+	TokenFile string `json:"token_file"` // one "name:token" or bare token per line
+	AuditLog  string `json:"audit_log"`  // file for admin API changes; the process log if empty
+}
+
+// PoolConfig is a named set of backends with its own balancing strategy,
+// discovery and health checks.
+type PoolConfig struct {
+	Name             string            `json:"name"`
+	Strategy         string            `json:"strategy"`
+	HashKey          *HashKey          `json:"hash_key"` // for ring-hash and maglev; the path if unset
+	Discovery        DiscoveryConfig   `json:"discovery"`
+	Backends         []BackendConfig   `json:"backends"`
+	HealthCheck      *HealthCheck      `json:"health_check"`
+	OutlierDetection *OutlierDetection `json:"outlier_detection"`
+	SlowStart        *SlowStart        `json:"slow_start"`
+	Affinity         *Affinity         `json:"affinity"`
+	DrainTimeout     time.Duration     `json:"drain_timeout"` // wait for a removed backend's requests
+}
+
+// BackendConfig declares one static backend. Weight defaults to 1.
+type BackendConfig struct {
+	Address  string            `json:"address"`
+	Weight   *float64          `json:"weight"`
+	Zone     string            `json:"zone"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// RouteConfig sends matching requests to a pool. A request must match every
+// field that is set; empty fields match anything.
+type RouteConfig struct {
+	Host       string        `json:"host"`
+	PathPrefix string        `json:"path_prefix"`
+	PathRegex  string        `json:"path_regex"` // must match the whole path
+	Methods    []string      `json:"methods"`
+	Headers    []HeaderMatch `json:"headers"`
+	Pool       string        `json:"pool"`
+	Split      string        `json:"split"` // instead of pool
+	Mirror     *MirrorConfig `json:"mirror"`
+
+	pathRegex *regexp.Regexp // compiled by validate
+}
+
+// HeaderMatch requires a request header to have a value, or with neither
+// Value nor Regex set, just to be present.
+type HeaderMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Regex string `json:"regex"` // must match the whole value
+
+	regex *regexp.Regexp // compiled by validate
+}
+
+// fallbackPool names the pool for requests that match no route: the default
+// pool, or the first pool when there are no routes. "" means they get 404.
+func (c *Config) fallbackPool() string {
+	if c.DefaultPool == "" && len(c.Routes) == 0 {
+		return c.Pools[0].Name
+	}
+	return c.DefaultPool
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{
+		Listeners: []ListenerConfig{{Address: ":80"}},
+		Admin:     AdminConfig{Address: ":9090"},
+		Strategy:  "weighted-random",
+		Timeouts: Timeouts{
+			ReadHeader:     10 * time.Second,
+			Read:           60 * time.Second,
+			Write:          90 * time.Second,
+			Idle:           120 * time.Second,
+			Dial:           5 * time.Second,
+			TLSHandshake:   10 * time.Second,
+			ResponseHeader: 30 * time.Second,
+			Upstream:       60 * time.Second,
+			StreamIdle:     5 * time.Minute,
+		},
+		Retries: RetryPolicy{
+			MaxAttempts: 1,
+			Conditions:  retryConditions,
+			BufferLimit: 1 << 20,
+		},
+		Shutdown: Shutdown{
+			ReadinessDelay: 5 * time.Second,
+			DrainTimeout:   30 * time.Second,
+		},
+		ReloadInterval: 5 * time.Second,
+	}
+	cfg.AccessLog.setDefaults()
+	cfg.Tracing.setDefaults()
+	return cfg
+}
+
+func (pc *PoolConfig) setDefaults() {
+	pc.Discovery.setDefaults()
+	pc.DrainTimeout = 30 * time.Second
+}
+
+// loadConfig reads the configuration file at path, which may be empty to
+// configure the balancer from the environment alone.
+func loadConfig(path string) (*Config, error) {
+	var data []byte
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return parseConfig(data)
+}
+
+// parseConfig decodes data over the defaults, applies environment overrides
+// and validates the result.
+func parseConfig(data []byte) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.lines = make(map[string]int)
+	root, err := parseConfigNode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeNode(root, reflect.ValueOf(cfg).Elem(), "", cfg.lines); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	cfg.normalize()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv applies the environment overrides. Top-level variables such as
+// LISTEN_ADDR, LB_STRATEGY or RETRY_MAX_ATTEMPTS override the matching
+// settings, and pool variables such as POD_IPS, DISCOVERY or
+// HEALTH_CHECK_PATH override the first pool, which is created if the file
+// has none.
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		c.Listeners = []ListenerConfig{{Address: v}}
+	}
+	c.Admin.Address = envOr("ADMIN_ADDR", c.Admin.Address)
+	c.Admin.TokenFile = envOr("ADMIN_TOKEN_FILE", c.Admin.TokenFile)
+	c.Admin.AuditLog = envOr("ADMIN_AUDIT_LOG", c.Admin.AuditLog)
+	if len(c.Pools) == 0 {
+		pc := &PoolConfig{Name: "default"}
+		pc.setDefaults()
+		c.Pools = []*PoolConfig{pc}
+	}
+	if v := os.Getenv("LB_STRATEGY"); v != "" {
+		c.Strategy = v
+		c.Pools[0].Strategy = v
+	}
+	var err error
+	if c.ReloadInterval, err = envDuration("CONFIG_POLL_INTERVAL", c.ReloadInterval); err != nil {
+		return err
+	}
+	for _, apply := range []func() error{
+		c.Pools[0].applyEnv,
+		c.Timeouts.applyEnv,
+		c.Retries.applyEnv,
+		c.Streaming.applyEnv,
+		c.Shutdown.applyEnv,
+		c.AccessLog.applyEnv,
+		c.Tracing.applyEnv,
+	} {
+		if err := apply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *PoolConfig) applyEnv() error {
+	if os.Getenv("POD_IPS") != "" {
+		backends, err := getBackends()
+		if err != nil {
+			return fmt.Errorf("POD_IPS: %v", err)
+		}
+		pc.Backends = pc.Backends[:0]
+		for _, b := range backends {
+			weight := b.Weight
+			pc.Backends = append(pc.Backends, BackendConfig{Address: b.Addr, Weight: &weight})
+		}
+	}
+	if err := pc.Discovery.applyEnv(); err != nil {
+		return err
+	}
+	var err error
+	if pc.DrainTimeout, err = envDuration("BACKEND_DRAIN_TIMEOUT", pc.DrainTimeout); err != nil {
+		return err
+	}
+	if pc.HealthCheck == nil && os.Getenv("HEALTH_CHECK_PATH") != "" {
+		pc.HealthCheck = &HealthCheck{}
+		pc.HealthCheck.setDefaults()
+	}
+	if pc.HealthCheck != nil {
+		if err := pc.HealthCheck.applyEnv(); err != nil {
+			return err
+		}
+	}
+	switch os.Getenv("OUTLIER_DETECTION") {
+	case "on":
+		if pc.OutlierDetection == nil {
+			pc.OutlierDetection = &OutlierDetection{}
+			pc.OutlierDetection.setDefaults()
+		}
+	case "off":
+		pc.OutlierDetection = nil
+	}
+	if pc.OutlierDetection != nil {
+		if err := pc.OutlierDetection.applyEnv(); err != nil {
+			return err
+		}
+	}
+	if pc.SlowStart == nil && os.Getenv("SLOW_START_WINDOW") != "" {
+		pc.SlowStart = &SlowStart{}
+		pc.SlowStart.setDefaults()
+	}
+	if pc.SlowStart != nil {
+		if err := pc.SlowStart.applyEnv(); err != nil {
+			return err
+		}
+	}
+	switch os.Getenv("AFFINITY") {
+	case "":
+	case "off":
+		pc.Affinity = nil
+	default:
+		if pc.Affinity == nil {
+			pc.Affinity = &Affinity{}
+			pc.Affinity.setDefaults()
+		}
+	}
+	if pc.HashKey == nil && os.Getenv("HASH_KEY") != "" {
+		pc.HashKey = &HashKey{}
+	}
+	if pc.HashKey != nil {
+		pc.HashKey.applyEnv()
+	}
+	if pc.Affinity != nil {
+		return pc.Affinity.applyEnv()
+	}
+	return nil
+}
+
+// normalize fills in settings that default to other settings.
+func (c *Config) normalize() {
+	for _, pc := range c.Pools {
+		if pc.Strategy == "" {
+			pc.Strategy = c.Strategy
+		}
+	}
+}
+
+// validator collects configuration errors, each prefixed with the line of
+// the offending setting when it came from the file.
+type validator struct {
+	lines map[string]int
+	errs  []string
+}
+
+// configErrors lists every problem found in a configuration.
+type configErrors []string
+
+func (e configErrors) Error() string { return strings.Join(e, "\n") }
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	msg := path + ": " + fmt.Sprintf(format, args...)
+	// Settings that were not in the file are reported at their closest
+	// ancestor that was.
+	for p := path; p != ""; p = parentPath(p) {
+		if line, ok := v.lines[p]; ok {
+			msg = fmt.Sprintf("line %d: %s", line, msg)
+			break
+		}
+	}
+	v.errs = append(v.errs, msg)
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return configErrors(v.errs)
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func (c *Config) validate() error {
+	v := &validator{lines: c.lines}
+	if len(c.Listeners) == 0 {
+		v.errorf("listeners", "at least one listener is required")
+	}
+	for i, l := range c.Listeners {
+		validateAddress(v, fmt.Sprintf("listeners[%d].address", i), l.Address)
+	}
+	validateAddress(v, "admin.address", c.Admin.Address)
+	if _, err := newPicker(c.Strategy); err != nil {
+		v.errorf("strategy", "%v", err)
+	}
+
+	names := make(map[string]bool)
+	for i, pc := range c.Pools {
+		path := fmt.Sprintf("pools[%d]", i)
+		if pc.Name == "" {
+			v.errorf(path+".name", "is required")
+		} else if names[pc.Name] {
+			v.errorf(path+".name", "duplicate pool name %q", pc.Name)
+		}
+		names[pc.Name] = true
+		// Pools that inherit the top-level strategy were checked above.
+		if _, err := newPicker(pc.Strategy); err != nil && pc.Strategy != c.Strategy {
+			v.errorf(path+".strategy", "%v", err)
+		}
+		pc.validate(v, path)
+	}
+	splits := make(map[string]bool)
+	for i, sc := range c.Splits {
+		path := fmt.Sprintf("splits[%d]", i)
+		if sc.Name == "" {
+			v.errorf(path+".name", "is required")
+		} else if splits[sc.Name] {
+			v.errorf(path+".name", "duplicate split name %q", sc.Name)
+		}
+		splits[sc.Name] = true
+		sc.validate(v, path, names)
+	}
+	for i, rc := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case (rc.Pool == "") == (rc.Split == ""):
+			v.errorf(path, "set exactly one of pool and split")
+		case rc.Split != "" && !splits[rc.Split]:
+			v.errorf(path+".split", "unknown split %q", rc.Split)
+		case rc.Pool != "" && !names[rc.Pool]:
+			v.errorf(path+".pool", "unknown pool %q", rc.Pool)
+		}
+		rc.validate(v, path)
+		if rc.Mirror != nil {
+			rc.Mirror.validate(v, path+".mirror", names)
+		}
+	}
+	if c.DefaultPool != "" && !names[c.DefaultPool] {
+		v.errorf("default_pool", "unknown pool %q", c.DefaultPool)
+	}
+
+	c.Timeouts.validate(v, "timeouts")
+	c.Retries.validate(v, "retries")
+	c.Streaming.validate(v, "streaming")
+	c.Shutdown.validate(v, "shutdown")
+	c.AccessLog.validate(v, "access_log")
+	c.Tracing.validate(v, "tracing")
+	if c.ReloadInterval <= 0 {
+		v.errorf("reload_interval", "must be positive")
+	}
+	return v.err()
+}
+
+func validateAddress(v *validator, path, addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		v.errorf(path, "invalid listen address %q, want host:port or :port", addr)
+	}
+}
+
+func (pc *PoolConfig) validate(v *validator, path string) {
+	pc.Discovery.validate(v, path+".discovery")
+	if pc.Discovery.isStatic() && len(pc.Backends) == 0 {
+		v.errorf(path+".backends", "static discovery needs at least one backend (or POD_IPS)")
+	}
+
+	seen := make(map[string]bool)
+	total, badWeight := 0.0, false
+	for i, bc := range pc.Backends {
+		bpath := fmt.Sprintf("%s.backends[%d]", path, i)
+		if bc.Address == "" {
+			v.errorf(bpath+".address", "is required")
+		} else if seen[bc.Address] {
+			v.errorf(bpath+".address", "backend %q listed more than once", bc.Address)
+		}
+		seen[bc.Address] = true
+		if w := bc.weight(); math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+			v.errorf(bpath+".weight", "must be a non-negative number, got %v", w)
+			badWeight = true
+		} else {
+			total += w
+		}
+	}
+	if len(pc.Backends) > 0 && total == 0 && !badWeight {
+		v.errorf(path+".backends", "total backend weight is zero")
+	}
+	if pc.DrainTimeout <= 0 {
+		v.errorf(path+".drain_timeout", "must be positive")
+	}
+
+	if pc.HealthCheck != nil {
+		pc.HealthCheck.validate(v, path+".health_check")
+	}
+	if pc.OutlierDetection != nil {
+		pc.OutlierDetection.validate(v, path+".outlier_detection")
+	}
+	if pc.SlowStart != nil {
+		pc.SlowStart.validate(v, path+".slow_start")
+	}
+	if pc.Affinity != nil {
+		pc.Affinity.validate(v, path+".affinity")
+	}
+	if pc.HashKey != nil {
+		pc.HashKey.validate(v, path+".hash_key")
+	}
+}
+
+func (bc BackendConfig) weight() float64 {
+	if bc.Weight == nil {
+		return 1
+	}
+	return *bc.Weight
+}
+
+// backends returns fresh Backend values for the configured backend set.
+func (pc *PoolConfig) backends() []*Backend {
+	backends := make([]*Backend, 0, len(pc.Backends))
+	for _, bc := range pc.Backends {
+		backends = append(backends, &Backend{
+			Addr:     bc.Address,
+			Weight:   bc.weight(),
+			Zone:     bc.Zone,
+			Metadata: bc.Metadata,
+		})
+	}
+	return backends
+}
+
+// applyConfig swaps the reloadable parts of cfg into the running pools and
+// router. The set of pools must not change; in-flight requests keep the
+// backend they were sent to.
+func applyConfig(cfg *Config) error {
+	if len(cfg.Pools) != len(pools) {
+		return fmt.Errorf("adding or removing pools requires a restart")
+	}
+	for _, pc := range cfg.Pools {
+		if pools[pc.Name] == nil {
+			return fmt.Errorf("pool %q is new; adding or removing pools requires a restart", pc.Name)
+		}
+	}
+	for _, pc := range cfg.Pools {
+		pool := pools[pc.Name]
+		if err := pool.SetStrategy(pc.Strategy); err != nil {
+			return err
+		}
+		pool.SetHashKey(pc.HashKey)
+		if pool.static {
+			pool.Update(pc.backends())
+		}
+	}
+	splits := buildSplits(cfg.Splits, pools, currentRouter.Load().(*Router).splits)
+	currentRouter.Store(newRouter(cfg.Routes, pools, splits, pools[cfg.fallbackPool()]))
+	return nil
+}
+
+// watchConfig reloads the file at path whenever its content changes, checked
+// every interval, and on SIGHUP. A file that fails to load or apply is logged
+// and the active configuration is kept.
+func watchConfig(ctx context.Context, path string, interval time.Duration, apply func(*Config) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := os.ReadFile(path)
+	for {
+		forced := false
+		select {
+		case <-ticker.C:
+		case <-hup:
+			forced = true
+		case <-ctx.Done():
+			return
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("config reload: %v; keeping the active configuration", err)
+			continue
+		}
+		if !forced && bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		cfg, err := parseConfig(data)
+		if err == nil {
+			err = apply(cfg)
+		}
+		if err != nil {
+			log.Printf("config reload: %s: %v; keeping the active configuration", path, err)
+			continue
+		}
+		log.Printf("config reloaded from %s", path)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration file is parsed into a tree of nodes that remember their
+// line, then decoded into Go values by decodeNode. This gives every error a
+// line number whether the file is YAML or JSON.
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mappingNode
+	sequenceNode
+)
+
+type node struct {
+	kind   nodeKind
+	line   int
+	value  string  // scalars only
+	quoted bool    // quoted scalars are always strings
+	null   bool    // ~, null or an empty value
+	keys   []*node // mappings: keys[i] maps to items[i]
+	items  []*node // mappings and sequences
+}
+
+// lineError is a configuration error tied to a line of the file.
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e *lineError) Error() string { return fmt.Sprintf("line %d: %s", e.line, e.msg) }
+
+func errorAt(line int, format string, args ...interface{}) error {
+	return &lineError{line, fmt.Sprintf(format, args...)}
+}
+
+// parseConfigNode parses JSON if data starts with "{" and YAML otherwise.
+func parseConfigNode(data []byte) (*node, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONNode(data)
+	}
+	return parseYAMLNode(data)
+}
+
+// parseJSONNode builds a node tree from a JSON document.
+func parseJSONNode(data []byte) (*node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+
+	var parse func() (*node, error)
+	parse = func() (*node, error) {
+		// InputOffset is the end of the previous token; skip the separators
+		// after it so the line is that of the value itself.
+		offset := dec.InputOffset()
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+			offset++
+		}
+		line := lineAt(offset)
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, jsonError(data, dec, err)
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			n := &node{kind: mappingNode, line: line}
+			if t == '[' {
+				n.kind = sequenceNode
+			}
+			seen := make(map[string]bool)
+			for dec.More() {
+				if n.kind == mappingNode {
+					key, err := parse()
+					if err != nil {
+						return nil, err
+					}
+					if seen[key.value] {
+						return nil, errorAt(key.line, "duplicate key %q", key.value)
+					}
+					seen[key.value] = true
+					n.keys = append(n.keys, key)
+				}
+				item, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, jsonError(data, dec, err)
+			}
+			return n, nil
+		case string:
+			return &node{kind: scalarNode, line: line, value: t, quoted: true}, nil
+		case json.Number:
+			return &node{kind: scalarNode, line: line, value: t.String()}, nil
+		case bool:
+			return &node{kind: scalarNode, line: line, value: strconv.FormatBool(t)}, nil
+		default:
+			return &node{kind: scalarNode, line: line, null: true}, nil
+		}
+	}
+	root, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errorAt(lineAt(dec.InputOffset()), "unexpected data after the top-level object")
+	}
+	return root, nil
+}
+
+func jsonError(data []byte, dec *json.Decoder, err error) error {
+	offset := dec.InputOffset()
+	if se, ok := err.(*json.SyntaxError); ok {
+		offset = se.Offset
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return errorAt(bytes.Count(data[:offset], []byte("\n"))+1, "%v", err)
+}
+
+// parseYAMLNode builds a node tree from the block-style YAML subset used for
+// configuration: nested mappings and sequences, plain and quoted scalars,
+// comments and single-line flow collections such as [GET, HEAD]. Anchors,
+// tags and multi-line scalars are not supported.
+func parseYAMLNode(data []byte) (*node, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		num := i + 1
+		text := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || (trimmed == "---" && len(p.lines) == 0) {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, errorAt(num, "tabs are not allowed for indentation")
+		}
+		if trimmed == "---" || trimmed == "..." {
+			return nil, errorAt(num, "only one YAML document is allowed")
+		}
+		p.lines = append(p.lines, yamlLine{indent: len(text) - len(trimmed), text: trimmed, num: num})
+	}
+	if len(p.lines) == 0 {
+		return &node{kind: mappingNode, line: 1}, nil
+	}
+	root, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, errorAt(p.lines[p.pos].num, "unexpected indentation")
+	}
+	return root, nil
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseBlock(indent int) (*node, error) {
+	if isSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (*node, error) {
+	seq := &node{kind: sequenceNode, line: p.lines[p.pos].num}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSequenceItem(p.lines[p.pos].text) {
+		l := p.lines[p.pos]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var item *node
+		var err error
+		switch {
+		case rest == "":
+			p.pos++
+			item, err = p.parseNested(indent, l.num, false)
+		case isSequenceItem(rest) || isMappingEntry(rest):
+			// "- key: value" or "- - item" starts a nested block whose
+			// indentation is that of the text after the dash.
+			p.lines[p.pos] = yamlLine{indent: l.indent + len(l.text) - len(rest), text: rest, num: l.num}
+			item, err = p.parseBlock(p.lines[p.pos].indent)
+		default:
+			p.pos++
+			item, err = parseYAMLScalar(rest, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		seq.items = append(seq.items, item)
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (*node, error) {
+	m := &node{kind: mappingNode, line: p.lines[p.pos].num}
+	seen := make(map[string]bool)
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && !isSequenceItem(p.lines[p.pos].text) {
+		l := p.lines[p.pos]
+		key, rest, ok := splitMappingEntry(l.text)
+		if !ok {
+			return nil, errorAt(l.num, "expected \"key: value\", got %q", l.text)
+		}
+		k, err := parseYAMLScalar(key, l.num)
+		if err != nil {
+			return nil, err
+		}
+		if seen[k.value] {
+			return nil, errorAt(l.num, "duplicate key %q", k.value)
+		}
+		seen[k.value] = true
+		p.pos++
+
+		var value *node
+		if rest == "" {
+			value, err = p.parseNested(indent, l.num, true)
+		} else {
+			value, err = parseYAMLScalar(rest, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.keys = append(m.keys, k)
+		m.items = append(m.items, value)
+	}
+	return m, nil
+}
+
+// parseNested parses the block belonging to a key or dash with no inline
+// value. The sequence under a mapping key may sit at the key's indentation.
+func (p *yamlParser) parseNested(indent, line int, isKey bool) (*node, error) {
+	if p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.indent > indent || (isKey && next.indent == indent && isSequenceItem(next.text)) {
+			return p.parseBlock(next.indent)
+		}
+	}
+	return &node{kind: scalarNode, line: line, null: true}, nil
+}
+
+func isMappingEntry(text string) bool {
+	_, _, ok := splitMappingEntry(text)
+	return ok
+}
+
+// splitMappingEntry splits "key: value" at the first colon outside quotes and
+// flow collections that is followed by a space or the end of the line.
+func splitMappingEntry(text string) (key, rest string, ok bool) {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ':' && depth == 0 && (i+1 == len(text) || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), i > 0
+		}
+	}
+	return "", "", false
+}
+
+// stripComment removes a "#" comment that is outside quotes and starts the
+// line or follows whitespace.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseYAMLScalar(text string, line int) (*node, error) {
+	switch {
+	case text == "" || text == "~" || text == "null":
+		return &node{kind: scalarNode, line: line, null: true}, nil
+	case text[0] == '"':
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, errorAt(line, "invalid double-quoted string %s", text)
+		}
+		return &node{kind: scalarNode, line: line, value: s, quoted: true}, nil
+	case text[0] == '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return nil, errorAt(line, "unterminated single-quoted string %s", text)
+		}
+		s := strings.ReplaceAll(text[1:len(text)-1], "''", "'")
+		return &node{kind: scalarNode, line: line, value: s, quoted: true}, nil
+	case text[0] == '[' || text[0] == '{':
+		return parseYAMLFlow(text, line)
+	case text[0] == '|' || text[0] == '>':
+		return nil, errorAt(line, "multi-line strings are not supported")
+	case text[0] == '&' || text[0] == '*' || text[0] == '!':
+		return nil, errorAt(line, "anchors, aliases and tags are not supported")
+	}
+	return &node{kind: scalarNode, line: line, value: text}, nil
+}
+
+// parseYAMLFlow parses a single-line flow sequence or mapping.
+func parseYAMLFlow(text string, line int) (*node, error) {
+	open, close := text[0], byte(']')
+	n := &node{kind: sequenceNode, line: line}
+	if open == '{' {
+		close, n.kind = '}', mappingNode
+	}
+	if text[len(text)-1] != close {
+		return nil, errorAt(line, "unterminated flow collection %s", text)
+	}
+	inner := strings.TrimSpace(text[1 : len(text)-1])
+	if inner == "" {
+		return n, nil
+	}
+	for _, part := range splitFlowItems(inner) {
+		part = strings.TrimSpace(part)
+		if n.kind == sequenceNode {
+			item, err := parseYAMLScalar(part, line)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			continue
+		}
+		key, rest, ok := splitMappingEntry(part)
+		if !ok {
+			return nil, errorAt(line, "expected \"key: value\" in %s", text)
+		}
+		k, err := parseYAMLScalar(key, line)
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseYAMLScalar(rest, line)
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, k)
+		n.items = append(n.items, v)
+	}
+	return n, nil
+}
+
+// splitFlowItems splits at commas outside quotes and nested collections.
+func splitFlowItems(s string) []string {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// defaulter is implemented by configuration structs whose zero value is not
+// a sensible default. setDefaults runs before the fields in the file are
+// decoded, so values written explicitly, including zeros, win.
+type defaulter interface {
+	setDefaults()
+}
+
+// decodeNode stores n in v, which must be settable, following the json tags
+// of struct fields. The line of every decoded value is recorded in lines
+// under its path, e.g. "pools[0].backends[1].weight".
+func decodeNode(n *node, v reflect.Value, path string, lines map[string]int) error {
+	lines[path] = n.line
+	if n.null && v.Kind() != reflect.Struct {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Type() == durationType {
+		if n.kind != scalarNode {
+			return errorAt(n.line, "%s: expected a duration such as \"5s\"", path)
+		}
+		if n.value == "0" {
+			v.SetInt(0)
+			return nil
+		}
+		d, err := time.ParseDuration(n.value)
+		if err != nil {
+			return errorAt(n.line, "%s: invalid duration %q", path, n.value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+			if d, ok := v.Interface().(defaulter); ok {
+				d.setDefaults()
+			}
+		}
+		return decodeNode(n, v.Elem(), path, lines)
+
+	case reflect.Struct:
+		if n.null {
+			return nil
+		}
+		if n.kind != mappingNode {
+			return errorAt(n.line, "%s: expected a mapping", path)
+		}
+		fields := structFields(v.Type())
+		for i, key := range n.keys {
+			idx, ok := fields[key.value]
+			if !ok {
+				return errorAt(key.line, "%sunknown field %q, want one of: %s", pathPrefix(path), key.value, fieldNames(v.Type()))
+			}
+			if err := decodeNode(n.items[i], v.Field(idx), joinPath(path, key.value), lines); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		if n.kind != sequenceNode {
+			return errorAt(n.line, "%s: expected a list", path)
+		}
+		s := reflect.MakeSlice(v.Type(), len(n.items), len(n.items))
+		for i, item := range n.items {
+			if err := decodeNode(item, s.Index(i), fmt.Sprintf("%s[%d]", path, i), lines); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+
+	case reflect.Map:
+		if n.kind != mappingNode || v.Type().Key().Kind() != reflect.String {
+			return errorAt(n.line, "%s: expected a mapping", path)
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(n.keys))
+		for i, key := range n.keys {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeNode(n.items[i], elem, joinPath(path, key.value), lines); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key.value).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+		return nil
+	}
+
+	if n.kind != scalarNode {
+		return errorAt(n.line, "%s: expected a single value", path)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(n.value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(n.value)
+		if err != nil || n.quoted {
+			return errorAt(n.line, "%s: expected true or false, got %q", path, n.value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(n.value, 10, 64)
+		if err != nil || n.quoted || v.OverflowInt(i) {
+			return errorAt(n.line, "%s: expected an integer, got %q", path, n.value)
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(n.value, 64)
+		if err != nil || n.quoted {
+			return errorAt(n.line, "%s: expected a number, got %q", path, n.value)
+		}
+		v.SetFloat(f)
+	default:
+		return errorAt(n.line, "%s: unsupported type %s", path, v.Type())
+	}
+	return nil
+}
+
+// structFields maps the json names of t's exported fields to their index.
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" || name == "" {
+			continue
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+func pathPrefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+func joinPath(path, field string) string {
+	switch {
+	case path == "":
+		return field
+	case field == "":
+		return path
+	}
+	return path + "." + field
+}
+
+// fieldNames lists t's configuration keys, for error messages.
+func fieldNames(t reflect.Type) string {
+	var names []string
+	for name := range structFields(t) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		check func(t *testing.T, c *Config)
+	}{
+		{
+			name: "sequences of mappings",
+			text: `
+pools:
+  - name: web
+    backends:
+      - address: 10.0.0.1:80
+        weight: 5
+      -   address: 10.0.0.2:80
+          zone: b
+  - name: api
+    backends:
+    - address: 10.0.1.1:80
+routes:
+  - path_prefix: /api/
+    headers:
+      - name: X-Env
+        value: prod
+      - name: X-Canary
+    pool: api
+default_pool: web
+`,
+			check: func(t *testing.T, c *Config) {
+				if len(c.Pools) != 2 || c.Pools[0].Name != "web" || c.Pools[1].Name != "api" {
+					t.Fatalf("pools = %+v", c.Pools)
+				}
+				web := c.Pools[0].Backends
+				if len(web) != 2 || web[0].Address != "10.0.0.1:80" || *web[0].Weight != 5 ||
+					web[1].Address != "10.0.0.2:80" || web[1].Zone != "b" || web[1].Weight != nil {
+					t.Errorf("web backends = %+v", web)
+				}
+				// A sequence may sit at its key's indentation.
+				if api := c.Pools[1].Backends; len(api) != 1 || api[0].Address != "10.0.1.1:80" {
+					t.Errorf("api backends = %+v", api)
+				}
+				h := c.Routes[0].Headers
+				if len(h) != 2 || h[0] != (HeaderMatch{Name: "X-Env", Value: "prod"}) || h[1].Name != "X-Canary" {
+					t.Errorf("headers = %+v", h)
+				}
+			},
+		},
+		{
+			name: "nested sequences",
+			text: `
+pools:
+  - name: web
+    backends: [{address: "10.0.0.1:80"}]
+splits:
+  - name: s
+    targets:
+      - pool: web
+        weight: 1
+routes:
+  -
+    path_prefix: /
+    split: s
+`,
+			check: func(t *testing.T, c *Config) {
+				if len(c.Splits) != 1 || len(c.Splits[0].Targets) != 1 || c.Splits[0].Targets[0].Pool != "web" {
+					t.Errorf("splits = %+v", c.Splits)
+				}
+				if len(c.Routes) != 1 || c.Routes[0].Split != "s" {
+					t.Errorf("routes = %+v", c.Routes)
+				}
+				if b := c.Pools[0].Backends; len(b) != 1 || b[0].Address != "10.0.0.1:80" {
+					t.Errorf("backends = %+v", b)
+				}
+			},
+		},
+		{
+			name: "flow collections",
+			text: `
+pools:
+  - name: web
+    backends:
+      - address: 10.0.0.1:80
+        metadata: {version: v1, "tier": 'gold', note: "a, b"}
+routes:
+  - methods: [GET, "HEAD", 'OPTIONS']
+    pool: web
+retries:
+  on: [503, connect-failure]
+`,
+			check: func(t *testing.T, c *Config) {
+				if got, want := c.Routes[0].Methods, []string{"GET", "HEAD", "OPTIONS"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("methods = %q, want %q", got, want)
+				}
+				want := map[string]string{"version": "v1", "tier": "gold", "note": "a, b"}
+				if got := c.Pools[0].Backends[0].Metadata; !reflect.DeepEqual(got, want) {
+					t.Errorf("metadata = %q, want %q", got, want)
+				}
+				if got, want := c.Retries.Conditions, []string{"503", "connect-failure"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("retry conditions = %q, want %q", got, want)
+				}
+			},
+		},
+		{
+			name: "comments",
+			text: `# leading comment
+pools:  # trailing comment
+  - name: web   # the pool
+    backends:
+      # between items
+      - address: 10.0.0.1:80
+routes:
+  - path_prefix: "/a#b"  # quoted hash
+    headers:
+      - name: X-Tag
+        value: 'c # d'
+      - name: X-Plain
+        value: e#f
+    pool: web
+`,
+			check: func(t *testing.T, c *Config) {
+				r := c.Routes[0]
+				if r.PathPrefix != "/a#b" {
+					t.Errorf("path_prefix = %q, want /a#b", r.PathPrefix)
+				}
+				if r.Headers[0].Value != "c # d" {
+					t.Errorf("quoted value = %q, want %q", r.Headers[0].Value, "c # d")
+				}
+				// A hash only starts a comment after whitespace.
+				if r.Headers[1].Value != "e#f" {
+					t.Errorf("plain value = %q, want e#f", r.Headers[1].Value)
+				}
+			},
+		},
+		{
+			name: "scalars",
+			text: `
+pools:
+  - name: "123"
+    backends:
+      - address: 10.0.0.1:80
+        weight: 2.5
+        zone: 'it''s'
+        metadata:
+          port: 8080
+          enabled: true
+          escaped: "tab\there"
+    health_check:
+      path: /healthz
+      healthy_threshold: 3
+access_log:
+  sample_rate: .25
+  output: "off"
+`,
+			check: func(t *testing.T, c *Config) {
+				p := c.Pools[0]
+				if p.Name != "123" {
+					t.Errorf("name = %q, want 123", p.Name)
+				}
+				b := p.Backends[0]
+				if *b.Weight != 2.5 || b.Zone != "it's" {
+					t.Errorf("backend = weight %v zone %q", *b.Weight, b.Zone)
+				}
+				want := map[string]string{"port": "8080", "enabled": "true", "escaped": "tab\there"}
+				if !reflect.DeepEqual(b.Metadata, want) {
+					t.Errorf("metadata = %q, want %q", b.Metadata, want)
+				}
+				if p.HealthCheck.HealthyThreshold != 3 || p.HealthCheck.Path != "/healthz" {
+					t.Errorf("health check = %+v", p.HealthCheck)
+				}
+				// Settings left out keep their defaults.
+				if p.HealthCheck.Interval != 5*time.Second {
+					t.Errorf("health check interval = %v, want the 5s default", p.HealthCheck.Interval)
+				}
+				if c.AccessLog.SampleRate != 0.25 || c.AccessLog.Output != "off" {
+					t.Errorf("access log = %+v", c.AccessLog)
+				}
+			},
+		},
+		{
+			name: "durations",
+			text: `
+pools:
+  - name: web
+    backends:
+      - address: 10.0.0.1:80
+timeouts:
+  upstream: 1m30s
+  write: "250ms"
+  idle: 0
+  stream_idle: ~
+`,
+			check: func(t *testing.T, c *Config) {
+				tt := c.Timeouts
+				if tt.Upstream != 90*time.Second || tt.Write != 250*time.Millisecond || tt.Idle != 0 || tt.StreamIdle != 0 {
+					t.Errorf("timeouts = %+v", tt)
+				}
+			},
+		},
+		{
+			name: "json",
+			text: `{
+  "pools": [
+    {"name": "web", "backends": [{"address": "10.0.0.1:80", "weight": 3}]}
+  ],
+  "routes": [{"methods": ["GET"], "pool": "web"}],
+  "timeouts": {"upstream": "10s"},
+  "tracing": {"sample_rate": 0.5}
+}`,
+			check: func(t *testing.T, c *Config) {
+				if *c.Pools[0].Backends[0].Weight != 3 || c.Routes[0].Methods[0] != "GET" ||
+					c.Timeouts.Upstream != 10*time.Second || c.Tracing.SampleRate != 0.5 {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseConfig([]byte(tt.text))
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	const pool = `
+pools:
+  - name: web
+    backends:
+      - address: 10.0.0.1:80
+`
+	tests := []struct {
+		name, text, want string
+	}{
+		{"unknown key", pool + "timeout:\n  upstream: 5s\n",
+			`line 6: unknown field "timeout", want one of:`},
+		{"unknown nested key", pool + "        wieght: 2\n",
+			`line 6: pools[0].backends[0]: unknown field "wieght", want one of: address, metadata, weight, zone`},
+		{"duplicate key", pool + "timeouts:\n  upstream: 5s\n  upstream: 6s\n",
+			`line 8: duplicate key "upstream"`},
+		{"duplicate pool key", pool + "    name: api\n",
+			`line 6: duplicate key "name"`},
+		{"invalid duration", pool + "timeouts:\n  upstream: 5 seconds\n",
+			`line 7: timeouts.upstream: invalid duration "5 seconds"`},
+		{"duration without unit", pool + "timeouts:\n  upstream: 5\n",
+			`line 7: timeouts.upstream: invalid duration "5"`},
+		{"quoted number", pool + "        weight: \"2\"\n",
+			`line 6: pools[0].backends[0].weight: expected a number, got "2"`},
+		{"quoted bool", pool + "access_log:\n  output: off\ntracing:\n  sample_rate: yes\n",
+			`line 9: tracing.sample_rate: expected a number, got "yes"`},
+		{"list for mapping", pool + "timeouts: [5s]\n",
+			`line 6: timeouts: expected a mapping`},
+		{"mapping for list", "pools:\n  name: web\n",
+			`line 2: pools: expected a list`},
+		{"tab indentation", "pools:\n\t- name: web\n",
+			`line 2: tabs are not allowed for indentation`},
+		{"bad indentation", pool + "   stray: 1\n",
+			`line 6: unexpected indentation`},
+		{"not a mapping entry", pool + "just text\n",
+			`line 6: expected "key: value", got "just text"`},
+		{"unterminated flow", pool + "routes:\n  - methods: [GET, HEAD\n    pool: web\n",
+			`line 7: unterminated flow collection [GET, HEAD`},
+		{"unterminated quote", pool + "default_pool: 'web\n",
+			`line 6: unterminated single-quoted string 'web`},
+		{"anchor", pool + "default_pool: &p web\n",
+			`line 6: anchors, aliases and tags are not supported`},
+		{"multi-line string", pool + "default_pool: |\n  web\n",
+			`line 6: multi-line strings are not supported`},
+		{"second document", pool + "---\nstrategy: p2c\n",
+			`line 6: only one YAML document is allowed`},
+		{"validation at the setting's line", pool + "        weight: -1\n",
+			`line 6: pools[0].backends[0].weight: must be a non-negative number`},
+		{"validation at the closest ancestor", pool + "routes:\n  - path_prefix: /\n",
+			`line 7: routes[0]: set exactly one of pool and split`},
+		{"json unknown key", "{\n  \"pools\": [],\n  \"bogus\": 1\n}",
+			`line 3: unknown field "bogus"`},
+		{"json syntax error", "{\n  \"pools\": [\n    {\"name\": \"web\",}\n  ]\n}",
+			`line 3: invalid character`},
+		{"json duplicate key", "{\n  \"strategy\": \"p2c\",\n  \"strategy\": \"round-robin\"\n}",
+			`line 3: duplicate key "strategy"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.text))
+			if err == nil {
+				t.Fatalf("parseConfig succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigLines(t *testing.T) {
+	c, err := parseConfig([]byte(`pools:
+  - name: web
+    backends:
+      - address: 10.0.0.1:80
+
+      - address: 10.0.0.2:80
+        # comment
+        weight: 2
+routes:
+  - methods: [GET]
+    pool: web
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A nested block is at the line it starts on.
+	for path, want := range map[string]int{
+		"pools":                        2,
+		"pools[0]":                     2,
+		"pools[0].name":                2,
+		"pools[0].backends[1]":         6,
+		"pools[0].backends[1].address": 6,
+		"pools[0].backends[1].weight":  8,
+		"routes[0].methods[0]":         10,
+		"routes[0].pool":               11,
+	} {
+		if got := c.lines[path]; got != want {
+			t.Errorf("line of %s = %d, want %d", path, got, want)
+		}
+	}
+}
+
+// TestParseConfigExample checks that the example configuration is valid and
+// decodes the same as its JSON rendering.
+func TestParseConfigExample(t *testing.T) {
+	data, err := os.ReadFile("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := parseConfig(data)
+	if err != nil {
+		t.Fatalf("config.example.yaml: %v", err)
+	}
+	root, err := parseYAMLNode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	writeNodeJSON(&sb, root)
+	fromJSON, err := parseConfig([]byte(sb.String()))
+	if err != nil {
+		t.Fatalf("JSON rendering: %v\n%s", err, sb.String())
+	}
+	fromYAML.lines, fromJSON.lines = nil, nil
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		a, _ := json.MarshalIndent(fromYAML, "", "  ")
+		b, _ := json.MarshalIndent(fromJSON, "", "  ")
+		t.Errorf("YAML and JSON decode differently:\n%s\nvs\n%s", a, b)
+	}
+}
+
+// writeNodeJSON renders n as JSON, keeping quoted scalars strings.
+func writeNodeJSON(sb *strings.Builder, n *node) {
+	switch {
+	case n.null:
+		sb.WriteString("null")
+	case n.kind == sequenceNode:
+		sb.WriteString("[")
+		for i, item := range n.items {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			writeNodeJSON(sb, item)
+		}
+		sb.WriteString("]")
+	case n.kind == mappingNode:
+		sb.WriteString("{")
+		for i, key := range n.keys {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(strconv.Quote(key.value) + ":")
+			writeNodeJSON(sb, n.items[i])
+		}
+		sb.WriteString("}")
+	default:
+		_, numErr := strconv.ParseFloat(n.value, 64)
+		if !n.quoted && (numErr == nil || n.value == "true" || n.value == "false") {
+			sb.WriteString(n.value)
+		} else {
+			sb.WriteString(strconv.Quote(n.value))
+		}
+	}
+}
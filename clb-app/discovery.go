@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DiscoveryConfig selects where a pool's backends come from: the static
+// backends list, the EndpointSlices of a Kubernetes Service, or DNS records.
+type DiscoveryConfig struct {
+	Mode string `json:"mode"` // static, kubernetes or dns
+
+	// kubernetes
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"` // defaults to the pod's own namespace
+	PortName  string `json:"port_name"` // defaults to the first TCP port
+
+	// dns; a name starting with "_" is looked up as an SRV record
+	Name string        `json:"name"`
+	Port int           `json:"port"` // for A/AAAA records
+	TTL  time.Duration `json:"ttl"`  // longest time before the name is resolved again; sooner if the records' TTL is shorter
+}
+
+func (dc *DiscoveryConfig) setDefaults() {
+	dc.Mode = "static"
+	dc.Service = "web-app-headless"
+	dc.Name = "web-app-headless"
+	dc.Port = 80
+	dc.TTL = 30 * time.Second
+}
+
+// applyEnv applies the DISCOVERY and DISCOVERY_* overrides.
+func (dc *DiscoveryConfig) applyEnv() error {
+	dc.Mode = envOr("DISCOVERY", dc.Mode)
+	dc.Service = envOr("DISCOVERY_SERVICE", dc.Service)
+	dc.Namespace = envOr("DISCOVERY_NAMESPACE", dc.Namespace)
+	dc.PortName = envOr("DISCOVERY_PORT_NAME", dc.PortName)
+	dc.Name = envOr("DISCOVERY_DNS_NAME", dc.Name)
+	var err error
+	if dc.Port, err = envInt("DISCOVERY_PORT", dc.Port); err != nil {
+		return err
+	}
+	if dc.TTL, err = envDuration("DISCOVERY_DNS_TTL", dc.TTL); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dc *DiscoveryConfig) validate(v *validator, path string) {
+	switch dc.Mode {
+	case "static":
+	case "kubernetes":
+		if dc.Service == "" {
+			v.errorf(path+".service", "is required for kubernetes discovery")
+		}
+	case "dns":
+		if dc.Name == "" {
+			v.errorf(path+".name", "is required for dns discovery")
+		}
+		if dc.Port <= 0 || dc.Port > 65535 {
+			v.errorf(path+".port", "must be between 1 and 65535, got %d", dc.Port)
+		}
+		if dc.TTL <= 0 {
+			v.errorf(path+".ttl", "must be positive")
+		}
+	default:
+		v.errorf(path+".mode", "unknown discovery mode %q, want static, kubernetes or dns", dc.Mode)
+	}
+}
+
+func (dc *DiscoveryConfig) isStatic() bool { return dc.Mode == "static" }
+
+// startDiscovery fills pool from the backend source configured for pc and, for
+// dynamic sources, keeps it up to date in the background until ctx is done.
+func startDiscovery(ctx context.Context, pool *Pool, pc *PoolConfig) error {
+	dc := &pc.Discovery
+	switch dc.Mode {
+	case "static":
+		pool.Update(pc.backends())
+
+	case "kubernetes":
+		client, err := newInClusterClient(dc.Namespace, dc.Service)
+		if err != nil {
+			return fmt.Errorf("kubernetes discovery: %v", err)
+		}
+		go watchEndpointSlices(ctx, client, dc.PortName, pool.Update)
+
+	case "dns":
+		resolver, err := newDNSClient(resolvConfPath)
+		if err != nil {
+			return fmt.Errorf("dns discovery: %v", err)
+		}
+		go watchDNS(ctx, resolver, dc.Name, dc.Port, dc.TTL, pool.Update)
+
+	default:
+		return fmt.Errorf("unknown discovery mode %q", dc.Mode)
+	}
+	return nil
+}
+
+// getBackends reads the static backend list from POD_IPS and POD_WEIGHTS.
+func getBackends() ([]*Backend, error) {
+	return parseBackends(os.Getenv("POD_IPS"), os.Getenv("POD_WEIGHTS"))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostResolver looks up the records DNS discovery reads, along with the
+// lowest TTL among them. dnsClient queries the DNS servers; tests can
+// substitute a fake.
+type hostResolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+}
+
+// minDNSPoll keeps records with a TTL of zero or a second from being looked
+// up in a tight loop.
+const minDNSPoll = time.Second
+
+// watchDNS resolves name and passes the result to update, and resolves it
+// again when the records' TTL runs out, or after maxInterval if that is
+// sooner. Names starting with an underscore (e.g.
+// "_http._tcp.web-app-headless") are looked up as SRV records, which supply
+// the port and weight of each backend; any other name is resolved to A/AAAA
+// records and combined with port. When a lookup fails the previous backend
+// set is kept and the lookup retried after maxInterval.
+func watchDNS(ctx context.Context, resolver hostResolver, name string, port int, maxInterval time.Duration, update func([]*Backend)) {
+	var last string
+	for {
+		lookupCtx, cancel := context.WithTimeout(ctx, maxInterval)
+		backends, ttl, err := resolveBackends(lookupCtx, resolver, name, port)
+		cancel()
+		wait := maxInterval
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("dns discovery: resolving %s: %v; keeping last known backends", name, err)
+		default:
+			if key := backendsKey(backends); key != last {
+				update(backends)
+				last = key
+			}
+			wait = dnsPollInterval(ttl, maxInterval)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dnsPollInterval returns how long to wait before looking up records with
+// the given TTL again.
+func dnsPollInterval(ttl, maxInterval time.Duration) time.Duration {
+	if ttl < minDNSPoll {
+		ttl = minDNSPoll
+	}
+	if ttl > maxInterval {
+		return maxInterval
+	}
+	return ttl
+}
+
+// resolveBackends looks up the backends behind name, returning the lowest
+// TTL of the records involved.
+func resolveBackends(ctx context.Context, resolver hostResolver, name string, port int) ([]*Backend, time.Duration, error) {
+	if !strings.HasPrefix(name, "_") {
+		return resolveHost(ctx, resolver, name, port, 1)
+	}
+
+	records, ttl, err := resolver.LookupSRV(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Only the most preferred priority is used; LookupSRV sorts by priority.
+	var backends []*Backend
+	for _, srv := range records {
+		if srv.Priority != records[0].Priority {
+			break
+		}
+		weight := float64(srv.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		resolved, hostTTL, err := resolveHost(ctx, resolver, srv.Target, int(srv.Port), weight)
+		if err != nil {
+			return nil, 0, err
+		}
+		if hostTTL < ttl {
+			ttl = hostTTL
+		}
+		backends = append(backends, resolved...)
+	}
+	return dedupeBackends(backends), ttl, nil
+}
+
+func resolveHost(ctx context.Context, resolver hostResolver, host string, port int, weight float64) ([]*Backend, time.Duration, error) {
+	ips, ttl, err := resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	backends := make([]*Backend, 0, len(ips))
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		backends = append(backends, &Backend{Addr: addr, Weight: weight})
+	}
+	return dedupeBackends(backends), ttl, nil
+}
+
+// dedupeBackends sorts backends by address and drops repeated addresses.
+func dedupeBackends(backends []*Backend) []*Backend {
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Addr < backends[j].Addr })
+	out := backends[:0]
+	for i, b := range backends {
+		if i == 0 || b.Addr != backends[i-1].Addr {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// backendsKey summarises a sorted backend set so unchanged lookups can be
+// skipped.
+func backendsKey(backends []*Backend) string {
+	var sb strings.Builder
+	for _, b := range backends {
+		sb.WriteString(b.Addr)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.FormatFloat(b.Weight, 'g', -1, 64))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRR struct {
+	typ   uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// fakeDNSServer answers queries on loopback UDP and TCP from a table of
+// records keyed by absolute name; unknown names get NXDOMAIN. UDP answers
+// for names in truncate only say that they were truncated.
+type fakeDNSServer struct {
+	addr     string
+	records  map[string][]testRR
+	truncate map[string]bool
+}
+
+func startFakeDNSServer(t *testing.T, records map[string][]testRR, truncate map[string]bool) *fakeDNSServer {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+	s := &fakeDNSServer{addr: udp.LocalAddr().String(), records: records, truncate: truncate}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.answer(buf[:n], true), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var size [2]byte
+			io.ReadFull(conn, size[:])
+			query := make([]byte, binary.BigEndian.Uint16(size[:]))
+			io.ReadFull(conn, query)
+			resp := s.answer(query, false)
+			binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+			conn.Write(append(size[:], resp...))
+			conn.Close()
+		}
+	}()
+	return s
+}
+
+func (s *fakeDNSServer) answer(query []byte, udp bool) []byte {
+	name, off, _ := readDNSName(query, 12)
+	qtype := binary.BigEndian.Uint16(query[off:])
+	resp := append([]byte(nil), query[:off+4]...)
+	resp[2] |= 0x80 // response
+	rrs, ok := s.records[name]
+	switch {
+	case !ok:
+		resp[3] |= 3 // NXDOMAIN
+		return resp
+	case udp && s.truncate[name]:
+		resp[2] |= 0x02
+		return resp
+	}
+	count := 0
+	for _, rr := range rrs {
+		if rr.typ != qtype && rr.typ != dnsTypeCNAME {
+			continue
+		}
+		count++
+		// The owner name points back at the question.
+		resp = append(resp, 0xc0, 12, byte(rr.typ>>8), byte(rr.typ), 0, 1)
+		resp = binary.BigEndian.AppendUint32(resp, rr.ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rr.rdata)))
+		resp = append(resp, rr.rdata...)
+	}
+	binary.BigEndian.PutUint16(resp[6:], uint16(count))
+	return resp
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func srvRR(ttl uint32, priority, weight, port uint16, target string) testRR {
+	rdata := binary.BigEndian.AppendUint16(nil, priority)
+	rdata = binary.BigEndian.AppendUint16(rdata, weight)
+	rdata = binary.BigEndian.AppendUint16(rdata, port)
+	return testRR{dnsTypeSRV, ttl, append(rdata, encodeName(target)...)}
+}
+
+func TestParseResolvConf(t *testing.T) {
+	c := parseResolvConf(`# written by the kubelet
+nameserver 10.96.0.10
+nameserver fd00::a
+search default.svc.cluster.local svc.cluster.local cluster.local.
+options ndots:5 timeout:2
+`)
+	if want := []string{"10.96.0.10:53", "[fd00::a]:53"}; !reflect.DeepEqual(c.servers, want) {
+		t.Errorf("servers = %q, want %q", c.servers, want)
+	}
+	if c.ndots != 5 {
+		t.Errorf("ndots = %d, want 5", c.ndots)
+	}
+	want := []string{"web.default.svc.cluster.local.", "web.svc.cluster.local.", "web.cluster.local.", "web."}
+	if got := c.candidates("web"); !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates(web) = %q, want %q", got, want)
+	}
+	if got := c.candidates("web.example.com."); !reflect.DeepEqual(got, []string{"web.example.com."}) {
+		t.Errorf("an absolute name is tried as is, got %q", got)
+	}
+	c.ndots = 1
+	if got := c.candidates("web.example.com"); got[0] != "web.example.com." {
+		t.Errorf("a name with ndots dots is tried first as is, got %q", got)
+	}
+	if got := parseResolvConf(""); !reflect.DeepEqual(got.servers, []string{"127.0.0.1:53"}) || got.ndots != 1 {
+		t.Errorf("empty resolv.conf: servers %q, ndots %d", got.servers, got.ndots)
+	}
+}
+
+func TestDNSClient(t *testing.T) {
+	const svc = "web.default.svc.cluster.local."
+	s := startFakeDNSServer(t, map[string][]testRR{
+		svc: {
+			{dnsTypeA, 7, []byte{10, 0, 0, 1}},
+			{dnsTypeA, 3, []byte{10, 0, 0, 2}},
+			{dnsTypeAAAA, 9, net.ParseIP("fd00::1")},
+		},
+		"alias.default.svc.cluster.local.": {
+			{dnsTypeCNAME, 2, encodeName(svc)},
+			{dnsTypeA, 30, []byte{10, 0, 0, 3}},
+		},
+		"_http._tcp.web.default.svc.cluster.local.": {
+			srvRR(20, 10, 1, 8081, "backup.default.svc.cluster.local."),
+			srvRR(20, 0, 3, 8080, "pod-a.default.svc.cluster.local."),
+			srvRR(20, 0, 1, 8080, "pod-b.default.svc.cluster.local."),
+		},
+		"pod-a.default.svc.cluster.local.":  {{dnsTypeA, 4, []byte{10, 0, 1, 1}}},
+		"pod-b.default.svc.cluster.local.":  {{dnsTypeA, 30, []byte{10, 0, 1, 2}}},
+		"backup.default.svc.cluster.local.": {{dnsTypeA, 1, []byte{10, 0, 2, 1}}},
+		"big.default.svc.cluster.local.":    {{dnsTypeA, 60, []byte{10, 0, 3, 1}}},
+		"empty.default.svc.cluster.local.":  {},
+	}, map[string]bool{"big.default.svc.cluster.local.": true})
+	c := &dnsClient{servers: []string{s.addr}, search: []string{"default.svc.cluster.local."}, ndots: 5}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		port    int
+		want    string
+		wantTTL time.Duration
+	}{
+		{"web", 80, "10.0.0.1:80=1,10.0.0.2:80=1,[fd00::1]:80=1,", 3 * time.Second},
+		{"alias", 80, "10.0.0.3:80=1,", 2 * time.Second},
+		// Only the lowest priority; the TTL of the targets' records counts.
+		{"_http._tcp.web", 0, "10.0.1.1:8080=3,10.0.1.2:8080=1,", 4 * time.Second},
+		// Truncated over UDP, answered over TCP.
+		{"big", 80, "10.0.3.1:80=1,", 60 * time.Second},
+	}
+	for _, tt := range tests {
+		backends, ttl, err := resolveBackends(ctx, c, tt.name, tt.port)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := backendsKey(backends); got != tt.want || ttl != tt.wantTTL {
+			t.Errorf("%s: got %s with TTL %v, want %s with TTL %v", tt.name, got, ttl, tt.want, tt.wantTTL)
+		}
+	}
+
+	for _, name := range []string{"missing", "empty", "_http._tcp.missing"} {
+		if _, _, err := resolveBackends(ctx, c, name, 80); !errors.Is(err, errDNSNotFound) {
+			t.Errorf("%s: got error %v, want %v", name, err, errDNSNotFound)
+		}
+	}
+}
+
+func TestDNSPollInterval(t *testing.T) {
+	for _, tt := range []struct{ ttl, max, want time.Duration }{
+		{5 * time.Second, 30 * time.Second, 5 * time.Second},
+		{time.Hour, 30 * time.Second, 30 * time.Second},
+		{0, 30 * time.Second, minDNSPoll},
+		{0, 500 * time.Millisecond, 500 * time.Millisecond},
+	} {
+		if got := dnsPollInterval(tt.ttl, tt.max); got != tt.want {
+			t.Errorf("dnsPollInterval(%v, %v) = %v, want %v", tt.ttl, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestReadDNSNameRejectsLoops(t *testing.T) {
+	msg := []byte{0xc0, 0x00} // a pointer to itself
+	if _, _, err := readDNSName(msg, 0); err != errDNSMalformed {
+		t.Errorf("got %v, want %v", err, errDNSMalformed)
+	}
+}
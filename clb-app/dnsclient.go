@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// DNS record types the client asks for or follows.
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+)
+
+var (
+	errDNSNotFound  = errors.New("no such host")
+	errDNSMalformed = errors.New("malformed DNS message")
+)
+
+// dnsClient is a minimal stub resolver for DNS discovery. Unlike Go's
+// resolver it reports the TTL of the records it returns, so that discovery
+// can look a name up again as soon as its records may have changed. Servers,
+// search domains and ndots come from resolv.conf, as in a pod.
+type dnsClient struct {
+	servers []string // host:port, tried in order
+	search  []string // absolute, with a trailing dot
+	ndots   int
+}
+
+func newDNSClient(path string) (*dnsClient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseResolvConf(string(data)), nil
+}
+
+func parseResolvConf(text string) *dnsClient {
+	c := &dnsClient{ndots: 1}
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case "nameserver":
+			c.servers = append(c.servers, net.JoinHostPort(f[1], "53"))
+		case "domain", "search":
+			// The last of either line wins, as in glibc.
+			c.search = nil
+			for _, d := range f[1:] {
+				c.search = append(c.search, strings.TrimSuffix(d, ".")+".")
+			}
+		case "options":
+			for _, o := range f[1:] {
+				if v := strings.TrimPrefix(o, "ndots:"); v != o {
+					if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+						c.ndots = n
+					}
+				}
+			}
+		}
+	}
+	if len(c.servers) == 0 {
+		c.servers = []string{"127.0.0.1:53"}
+	}
+	return c
+}
+
+// candidates returns the absolute names tried for name, in order: a name
+// with at least ndots dots is tried as is first, any other after the search
+// domains.
+func (c *dnsClient) candidates(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	var names []string
+	for _, d := range c.search {
+		names = append(names, name+"."+d)
+	}
+	if strings.Count(name, ".") >= c.ndots {
+		return append([]string{name + "."}, names...)
+	}
+	return append(names, name+".")
+}
+
+// dnsAnswer holds the records of one response. ttl is the lowest TTL among
+// them, CNAMEs followed on the way included.
+type dnsAnswer struct {
+	ips  []net.IP
+	srvs []*net.SRV
+	ttl  time.Duration
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host and how long they may
+// be cached.
+func (c *dnsClient) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	for _, name := range c.candidates(host) {
+		a, err := c.query(ctx, name, dnsTypeA)
+		if err != nil {
+			return nil, 0, fmt.Errorf("lookup %s: %v", host, err)
+		}
+		aaaa, err := c.query(ctx, name, dnsTypeAAAA)
+		if err != nil {
+			return nil, 0, fmt.Errorf("lookup %s: %v", host, err)
+		}
+		ttl := a.ttl
+		if len(a.ips) == 0 || (len(aaaa.ips) > 0 && aaaa.ttl < ttl) {
+			ttl = aaaa.ttl
+		}
+		if ips := append(a.ips, aaaa.ips...); len(ips) > 0 {
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("lookup %s: %w", host, errDNSNotFound)
+}
+
+// LookupSRV returns the SRV records of name sorted by priority, and how long
+// they may be cached.
+func (c *dnsClient) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	for _, fqdn := range c.candidates(name) {
+		ans, err := c.query(ctx, fqdn, dnsTypeSRV)
+		if err != nil {
+			return nil, 0, fmt.Errorf("lookup %s: %v", name, err)
+		}
+		if len(ans.srvs) > 0 {
+			sort.SliceStable(ans.srvs, func(i, j int) bool { return ans.srvs[i].Priority < ans.srvs[j].Priority })
+			return ans.srvs, ans.ttl, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("lookup %s: %w", name, errDNSNotFound)
+}
+
+// query asks the servers in turn for the records of type qtype of the
+// absolute name. A name that does not exist, or has no such records, gives an
+// empty answer.
+func (c *dnsClient) query(ctx context.Context, name string, qtype uint16) (dnsAnswer, error) {
+	id := uint16(mathrand.Intn(1 << 16))
+	msg, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+	var lastErr error
+	for _, server := range c.servers {
+		resp, err := exchangeDNS(ctx, server, msg)
+		if err == nil {
+			var ans dnsAnswer
+			if ans, err = parseDNSResponse(resp, id, qtype); err == nil {
+				return ans, nil
+			}
+		}
+		lastErr = fmt.Errorf("server %s: %v", server, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return dnsAnswer{}, lastErr
+}
+
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	// Header: recursion desired, one question.
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1), nil
+}
+
+// exchangeDNS sends query to server over UDP, and again over TCP if the
+// answer did not fit in a datagram.
+func exchangeDNS(ctx context.Context, server string, query []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue // not the reply to this query
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break // truncated
+	}
+
+	tcp, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(deadline)
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := tcp.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(tcp, buf[:2]); err != nil {
+		return nil, err
+	}
+	resp := buf[:binary.BigEndian.Uint16(buf)]
+	if _, err := io.ReadFull(tcp, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func parseDNSResponse(msg []byte, id, qtype uint16) (dnsAnswer, error) {
+	var ans dnsAnswer
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return ans, errDNSMalformed
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		return ans, nil
+	default:
+		return ans, fmt.Errorf("DNS error, rcode %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return ans, err
+		}
+		off += 4 // type and class
+	}
+	seen := false
+	for i := 0; i < answers; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return ans, err
+		}
+		if off+10 > len(msg) {
+			return ans, errDNSMalformed
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return ans, errDNSMalformed
+		}
+		rdata := msg[off : off+rdlen]
+		switch {
+		case typ == dnsTypeA && qtype == dnsTypeA && rdlen == net.IPv4len,
+			typ == dnsTypeAAAA && qtype == dnsTypeAAAA && rdlen == net.IPv6len:
+			ans.ips = append(ans.ips, append(net.IP(nil), rdata...))
+		case typ == dnsTypeSRV && qtype == dnsTypeSRV && rdlen > 6:
+			target, _, err := readDNSName(msg, off+6)
+			if err != nil {
+				return ans, err
+			}
+			ans.srvs = append(ans.srvs, &net.SRV{
+				Target:   target,
+				Priority: binary.BigEndian.Uint16(rdata),
+				Weight:   binary.BigEndian.Uint16(rdata[2:]),
+				Port:     binary.BigEndian.Uint16(rdata[4:]),
+			})
+		case typ == dnsTypeCNAME:
+		default:
+			off += rdlen
+			continue
+		}
+		off += rdlen
+		if !seen || ttl < ans.ttl {
+			ans.ttl, seen = ttl, true
+		}
+	}
+	return ans, nil
+}
+
+// readDNSName reads the possibly compressed name at off in msg and returns it
+// with a trailing dot, along with the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps >= 16 {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case n&0xc0 != 0:
+			return "", 0, errDNSMalformed
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envDuration reads a positive duration such as "5s" from key.
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, v)
+	}
+	return d, nil
+}
+
+// envInt reads a positive integer from key.
+func envInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s: invalid positive integer %q", key, v)
+	}
+	return n, nil
+}
+
+// envNonNegInt reads a non-negative integer from key, for settings where 0
+// turns something off.
+func envNonNegInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid non-negative integer %q", key, v)
+	}
+	return n, nil
+}
+
+// envFloat reads a non-negative number from key.
+func envFloat(key string, fallback float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s: invalid non-negative number %q", key, v)
+	}
+	return f, nil
+}
+
+// envTimeout reads a duration from key where "0" disables the timeout.
+func envTimeout(key string, fallback time.Duration) (time.Duration, error) {
+	if os.Getenv(key) == "0" {
+		return 0, nil
+	}
+	return envDuration(key, fallback)
+}
+
+// envSize reads a non-negative byte count from key.
+func envSize(key string, fallback int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid size in bytes %q", key, v)
+	}
+	return n, nil
+}
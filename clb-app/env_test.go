@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestEnvInts(t *testing.T) {
+	for _, tt := range []struct {
+		value          string
+		positive, zero bool // accepted by envInt, envNonNegInt
+	}{
+		{"3", true, true},
+		{"0", false, true},
+		{"-1", false, false},
+		{"x", false, false},
+	} {
+		t.Setenv("TEST_INT", tt.value)
+		if _, err := envInt("TEST_INT", 7); (err == nil) != tt.positive {
+			t.Errorf("envInt(%q): error %v", tt.value, err)
+		}
+		if _, err := envNonNegInt("TEST_INT", 7); (err == nil) != tt.zero {
+			t.Errorf("envNonNegInt(%q): error %v", tt.value, err)
+		}
+	}
+}
+
+func TestOutlierEnvAcceptsZero(t *testing.T) {
+	t.Setenv("OUTLIER_MAX_EJECTION_PERCENT", "0")
+	t.Setenv("OUTLIER_CONSECUTIVE_ERRORS", "0")
+	od := &OutlierDetection{}
+	od.setDefaults()
+	if err := od.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if od.MaxEjectionPercent != 0 || od.ConsecutiveErrors != 0 {
+		t.Errorf("max ejection percent %d, consecutive errors %d; want 0 and 0", od.MaxEjectionPercent, od.ConsecutiveErrors)
+	}
+}
+
+func TestAccessLogEnvAcceptsZeroBackups(t *testing.T) {
+	t.Setenv("ACCESS_LOG_MAX_BACKUPS", "0")
+	al := &AccessLog{}
+	al.setDefaults()
+	if err := al.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if al.MaxBackups != 0 {
+		t.Errorf("max backups %d, want 0", al.MaxBackups)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// statusClientClosedRequest is nginx's non-standard status for requests the
+// client abandoned before a response was sent. It is only ever logged.
+const statusClientClosedRequest = 499
+
+// requestIDHeader carries the request ID to the backend and back to the
+// client.
+const requestIDHeader = "X-Request-Id"
+
+// errorSourceHeader marks responses generated by the balancer itself rather
+// than relayed from a backend.
+const errorSourceHeader = "X-Load-Balancer-Error"
+
+// ensureRequestID keeps the client's request ID or assigns a new one, and
+// echoes it in the response.
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// upstreamErrorStatus maps a failed upstream attempt to a gateway status code.
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, errPerTryTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeUpstreamError reports a failed proxied request to the client, or only
+// logs it if the client is already gone.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, backend *Backend, err error) {
+	if r.Context().Err() == context.Canceled {
+		log.Printf("%d %s %s request %s: client closed request while waiting for %s",
+			statusClientClosedRequest, r.Method, r.URL.Path, r.Header.Get(requestIDHeader), backend.Addr)
+		return
+	}
+	status := upstreamErrorStatus(err)
+	log.Printf("%d %s %s request %s: backend %s: %v", status, r.Method, r.URL.Path, r.Header.Get(requestIDHeader), backend.Addr, err)
+	if status == http.StatusGatewayTimeout {
+		writeError(w, r, status, "upstream_timeout", "The backend did not respond in time")
+		return
+	}
+	writeError(w, r, status, "upstream_unreachable", "The backend could not be reached")
+}
+
+// writeError sends an error generated by the balancer as JSON if the client
+// accepts it, and as plain text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	id := r.Header.Get(requestIDHeader)
+	h := w.Header()
+	h.Set(errorSourceHeader, code)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+
+	if acceptsJSON(r) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Status    int    `json:"status"`
+			Error     string `json:"error"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+			Source    string `json:"source"`
+		}{status, code, message, id, "load-balancer"})
+		return
+	}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d %s: %s (request %s)\n", status, http.StatusText(status), message, id)
+}
+
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+			if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HashKey is the part of a request the ring-hash and maglev strategies hash
+// to choose a backend, so that requests with the same key go to the same
+// backend. Requests without the key are balanced by weight.
+type HashKey struct {
+	Source string `json:"source"` // "header", "cookie", "path" or "query"
+	Name   string `json:"name"`   // the header, cookie or query parameter
+}
+
+// applyEnv applies HASH_KEY, e.g. "path" or "header:X-User-ID".
+func (k *HashKey) applyEnv() {
+	if v := os.Getenv("HASH_KEY"); v != "" {
+		k.Source, k.Name = v, ""
+		if i := strings.Index(v, ":"); i >= 0 {
+			k.Source, k.Name = v[:i], v[i+1:]
+		}
+	}
+}
+
+func (k *HashKey) validate(v *validator, path string) {
+	switch k.Source {
+	case "header", "cookie", "query":
+		if k.Name == "" {
+			v.errorf(path+".name", "is required for a %s key", k.Source)
+		}
+	case "path":
+		if k.Name != "" {
+			v.errorf(path+".name", "is not used for a path key")
+		}
+	default:
+		v.errorf(path+".source", "must be header, cookie, path or query, got %q", k.Source)
+	}
+}
+
+// value returns r's key. A nil HashKey hashes the path.
+func (k *HashKey) value(r *http.Request) (string, bool) {
+	if k == nil {
+		return r.URL.Path, true
+	}
+	switch k.Source {
+	case "header":
+		v := r.Header.Get(k.Name)
+		return v, v != ""
+	case "cookie":
+		c, err := r.Cookie(k.Name)
+		if err != nil || c.Value == "" {
+			return "", false
+		}
+		return c.Value, true
+	case "query":
+		v := r.URL.Query().Get(k.Name)
+		return v, v != ""
+	}
+	return r.URL.Path, true
+}
+
+// hashPicker is a Picker that can map a request's key onto the candidates.
+type hashPicker interface {
+	Picker
+	PickHash(candidates []*Backend, hash uint64) *Backend
+}
+
+// hashTables caches the lookup structure built for each recent candidate
+// set, since building one is far more expensive than a lookup. The set
+// changes with discovery, health and retries, which exclude backends. Sets
+// are told apart by backend identity, not address: a backend removed and
+// added again at the same address is a new object the table must point to.
+type hashTables struct {
+	mu     sync.Mutex
+	tables map[string]interface{}
+	build  func(candidates []*Backend) interface{}
+}
+
+func (t *hashTables) get(candidates []*Backend) interface{} {
+	var sig strings.Builder
+	for _, b := range candidates {
+		fmt.Fprintf(&sig, "%p=", b)
+		sig.WriteString(strconv.FormatFloat(b.Weight, 'g', -1, 64))
+		sig.WriteByte(',')
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if table, ok := t.tables[sig.String()]; ok {
+		return table
+	}
+	if len(t.tables) >= 16 {
+		t.tables = nil
+	}
+	if t.tables == nil {
+		t.tables = make(map[string]interface{})
+	}
+	table := t.build(candidates)
+	t.tables[sig.String()] = table
+	return table
+}
+
+// ringHashPicker places every backend on a hash ring at a number of points
+// proportional to its weight and sends a key to the first point at or after
+// its hash. Removing a backend only moves the keys that were on its points.
+type ringHashPicker struct {
+	tables hashTables
+}
+
+// ringPoints is the number of points of the heaviest backend on a ring;
+// others get points in proportion to their weight. More points keep each
+// backend's share of keys closer to its share of the weight. Scaling by the
+// heaviest backend rather than the total means that adding or removing a
+// backend leaves the points of the others alone.
+const ringPoints = 1024
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+func newRingHashPicker() *ringHashPicker {
+	p := &ringHashPicker{}
+	p.tables.build = func(candidates []*Backend) interface{} { return buildRing(candidates) }
+	return p
+}
+
+func buildRing(candidates []*Backend) []ringPoint {
+	maxWeight := 0.0
+	for _, b := range candidates {
+		maxWeight = math.Max(maxWeight, b.Weight)
+	}
+	var ring []ringPoint
+	for _, b := range candidates {
+		if b.Weight <= 0 {
+			continue
+		}
+		n := int(math.Ceil(b.Weight / maxWeight * ringPoints))
+		for i := 0; i < n; i++ {
+			ring = append(ring, ringPoint{hash64(b.Addr, strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func (p *ringHashPicker) Pick(candidates []*Backend) *Backend {
+	return weightedChoice(candidates)
+}
+
+func (p *ringHashPicker) PickHash(candidates []*Backend, hash uint64) *Backend {
+	ring := p.tables.get(candidates).([]ringPoint)
+	if len(ring) == 0 {
+		return nil
+	}
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].backend
+}
+
+// maglevPicker is Google's Maglev consistent hashing: each backend fills a
+// lookup table in the order of its own permutation, taking turns in
+// proportion to its weight. Lookups are a single index, the load is spread
+// more evenly than on a ring, and a change in the backend set moves only
+// slightly more keys than the minimum.
+type maglevPicker struct {
+	tables hashTables
+}
+
+// maglevTableSize is prime, as the permutations require, and large enough
+// for every backend to own many entries.
+const maglevTableSize = 65537
+
+func newMaglevPicker() *maglevPicker {
+	p := &maglevPicker{}
+	p.tables.build = func(candidates []*Backend) interface{} { return buildMaglevTable(candidates) }
+	return p
+}
+
+func buildMaglevTable(candidates []*Backend) []*Backend {
+	type entry struct {
+		b            *Backend
+		offset, skip uint64
+		next         uint64  // position in the permutation
+		weight       float64 // normalized so the heaviest backend has 1
+		target       float64
+	}
+	maxWeight := 0.0
+	for _, b := range candidates {
+		maxWeight = math.Max(maxWeight, b.Weight)
+	}
+	var entries []*entry
+	for _, b := range candidates {
+		if b.Weight <= 0 {
+			continue
+		}
+		entries = append(entries, &entry{
+			b:      b,
+			offset: hash64(b.Addr, "offset") % maglevTableSize,
+			skip:   hash64(b.Addr, "skip")%(maglevTableSize-1) + 1,
+			weight: b.Weight / maxWeight,
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	table := make([]*Backend, maglevTableSize)
+	filled := 0
+	for round := 1.0; filled < maglevTableSize; round++ {
+		for _, e := range entries {
+			// A backend with half the heaviest weight takes every other
+			// turn, and so on.
+			if round*e.weight < e.target {
+				continue
+			}
+			e.target++
+			for {
+				slot := (e.offset + e.next*e.skip) % maglevTableSize
+				e.next++
+				if table[slot] == nil {
+					table[slot] = e.b
+					filled++
+					break
+				}
+			}
+			if filled == maglevTableSize {
+				break
+			}
+		}
+	}
+	return table
+}
+
+func (p *maglevPicker) Pick(candidates []*Backend) *Backend {
+	return weightedChoice(candidates)
+}
+
+func (p *maglevPicker) PickHash(candidates []*Backend, hash uint64) *Backend {
+	table := p.tables.get(candidates).([]*Backend)
+	if len(table) == 0 {
+		return nil
+	}
+	return table[hash%maglevTableSize]
+}
+
+// hash64 hashes parts, kept apart by a separator, with FNV-1a and a final
+// mix so that similar inputs such as neighbouring IPs spread evenly.
+func hash64(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+const hashTestKeys = 100000
+
+// hashPickers are the consistent hashing strategies under test.
+var hashPickers = []struct {
+	name string
+	new  func() hashPicker
+	// stray bounds the fraction of keys that may move between backends
+	// a change left alone. The ring moves none; maglev trades a few for
+	// its even spread.
+	stray float64
+}{
+	{"ring-hash", func() hashPicker { return newRingHashPicker() }, 0},
+	{"maglev", func() hashPicker { return newMaglevPicker() }, 0.01},
+}
+
+// mapKeys returns the backend p picks for each test key.
+func mapKeys(p hashPicker, backends []*Backend) []*Backend {
+	picks := make([]*Backend, hashTestKeys)
+	for i := range picks {
+		picks[i] = p.PickHash(backends, hash64("key", strconv.Itoa(i)))
+	}
+	return picks
+}
+
+// checkRemap fails t unless about want of the keys moved from before to
+// after, and almost all of them moved away from or onto changed.
+func checkRemap(t *testing.T, before, after []*Backend, changed *Backend, want, stray float64) {
+	t.Helper()
+	moved, strayed := 0, 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		moved++
+		if before[i] != changed && after[i] != changed {
+			strayed++
+		}
+	}
+	if got := float64(moved) / hashTestKeys; got < want-0.02 || got > want+0.02+stray {
+		t.Errorf("%.3f of keys moved, want about %.3f", got, want)
+	}
+	if got := float64(strayed) / hashTestKeys; got > stray {
+		t.Errorf("%.4f of keys moved between unchanged backends, want at most %.4f", got, stray)
+	}
+}
+
+func TestHashPickerAddBackend(t *testing.T) {
+	for _, hp := range hashPickers {
+		t.Run(hp.name, func(t *testing.T) {
+			backends := testBackends(1, 1, 1, 1, 1, 1)
+			p := hp.new()
+			before := mapKeys(p, backends[:5])
+			after := mapKeys(p, backends)
+			checkRemap(t, before, after, backends[5], 1.0/6, hp.stray)
+		})
+	}
+}
+
+func TestHashPickerRemoveBackend(t *testing.T) {
+	for _, hp := range hashPickers {
+		t.Run(hp.name, func(t *testing.T) {
+			backends := testBackends(1, 1, 1, 1, 1)
+			p := hp.new()
+			before := mapKeys(p, backends)
+			after := mapKeys(p, []*Backend{backends[0], backends[1], backends[3], backends[4]})
+			checkRemap(t, before, after, backends[2], 1.0/5, hp.stray)
+		})
+	}
+}
+
+func TestHashPickerShares(t *testing.T) {
+	for _, hp := range hashPickers {
+		t.Run(hp.name, func(t *testing.T) {
+			backends := testBackends(1, 2, 3, 4)
+			picks := make(map[*Backend]int)
+			for _, b := range mapKeys(hp.new(), backends) {
+				picks[b]++
+			}
+			checkShares(t, backends, picks, hashTestKeys, 0.02)
+		})
+	}
+}
+
+func TestHashPickerSkipsZeroWeight(t *testing.T) {
+	for _, hp := range hashPickers {
+		t.Run(hp.name, func(t *testing.T) {
+			backends := testBackends(1, 0, 1)
+			for _, b := range mapKeys(hp.new(), backends) {
+				if b == backends[1] {
+					t.Fatal("key mapped to the backend with weight 0")
+				}
+			}
+		})
+	}
+}
+
+func TestHashPickerFollowsReplacedBackend(t *testing.T) {
+	for _, strategy := range []string{"ring-hash", "maglev"} {
+		t.Run(strategy, func(t *testing.T) {
+			p, err := newPool("web", strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Update(testBackends(1))
+			r := httptest.NewRequest("GET", "/key", nil)
+			p.Pick(r) // builds and caches the table
+
+			// Removed and added again through the admin API.
+			p.Remove("a")
+			added := &Backend{Addr: "a", Weight: 1}
+			if err := p.Add(added); err != nil {
+				t.Fatal(err)
+			}
+			if b := p.Pick(r); b != added {
+				t.Fatalf("after admin re-add: picked %p, want the pool's current backend %p", b, added)
+			}
+
+			// Dropped by discovery and rediscovered.
+			p.Remove("a")
+			rediscovered := testBackends(1)
+			p.Update(rediscovered)
+			if b := p.Pick(r); b != rediscovered[0] {
+				t.Fatalf("after rediscovery: picked %p, want the pool's current backend %p", b, rediscovered[0])
+			}
+		})
+	}
+}
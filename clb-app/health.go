@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures active probing of every backend in a pool.
+type HealthCheck struct {
+	Path               string        `json:"path"`
+	Interval           time.Duration `json:"interval"`
+	Timeout            time.Duration `json:"timeout"`
+	ExpectedStatus     string        `json:"expected_status"`     // "200" or a range such as "200-399"
+	HealthyThreshold   int           `json:"healthy_threshold"`   // consecutive successes to re-admit a backend
+	UnhealthyThreshold int           `json:"unhealthy_threshold"` // consecutive failures to eject a backend
+
+	statusMin, statusMax int // parsed from ExpectedStatus by validate
+}
+
+func (hc *HealthCheck) setDefaults() {
+	hc.Path = "/"
+	hc.Interval = 5 * time.Second
+	hc.Timeout = 2 * time.Second
+	hc.ExpectedStatus = "200-399"
+	hc.HealthyThreshold = 2
+	hc.UnhealthyThreshold = 3
+}
+
+// applyEnv applies the HEALTH_CHECK_* overrides.
+func (hc *HealthCheck) applyEnv() error {
+	hc.Path = envOr("HEALTH_CHECK_PATH", hc.Path)
+	hc.ExpectedStatus = envOr("HEALTH_CHECK_EXPECTED_STATUS", hc.ExpectedStatus)
+	var err error
+	if hc.Interval, err = envDuration("HEALTH_CHECK_INTERVAL", hc.Interval); err != nil {
+		return err
+	}
+	if hc.Timeout, err = envDuration("HEALTH_CHECK_TIMEOUT", hc.Timeout); err != nil {
+		return err
+	}
+	if hc.HealthyThreshold, err = envInt("HEALTH_CHECK_HEALTHY_THRESHOLD", hc.HealthyThreshold); err != nil {
+		return err
+	}
+	if hc.UnhealthyThreshold, err = envInt("HEALTH_CHECK_UNHEALTHY_THRESHOLD", hc.UnhealthyThreshold); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (hc *HealthCheck) validate(v *validator, path string) {
+	if !strings.HasPrefix(hc.Path, "/") {
+		v.errorf(path+".path", "must start with /, got %q", hc.Path)
+	}
+	if hc.Interval <= 0 {
+		v.errorf(path+".interval", "must be positive")
+	}
+	if hc.Timeout <= 0 {
+		v.errorf(path+".timeout", "must be positive")
+	}
+	var err error
+	if hc.statusMin, hc.statusMax, err = parseStatusRange(hc.ExpectedStatus); err != nil {
+		v.errorf(path+".expected_status", "%v", err)
+	}
+	if hc.HealthyThreshold < 1 {
+		v.errorf(path+".healthy_threshold", "must be at least 1")
+	}
+	if hc.UnhealthyThreshold < 1 {
+		v.errorf(path+".unhealthy_threshold", "must be at least 1")
+	}
+}
+
+// parseStatusRange parses "200" or "200-399".
+func parseStatusRange(s string) (min, max int, err error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	if min, err = strconv.Atoi(strings.TrimSpace(lo)); err == nil {
+		max, err = strconv.Atoi(strings.TrimSpace(hi))
+	}
+	if err != nil || min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("invalid status range %q", s)
+	}
+	return min, max, nil
+}
+
+// runHealthChecks probes every backend in pool each interval until ctx is
+// done, ejecting and re-admitting backends as they cross the thresholds.
+func runHealthChecks(ctx context.Context, pool *Pool, hc *HealthCheck) {
+	client := &http.Client{
+		Timeout: hc.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range pool.Backends() {
+			wg.Add(1)
+			go func(b *Backend) {
+				defer wg.Done()
+				hc.record(pool, b, hc.probe(ctx, client, b))
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (hc *HealthCheck) probe(ctx context.Context, client *http.Client, b *Backend) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+b.Addr+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "clb-app-health-check")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < hc.statusMin || resp.StatusCode > hc.statusMax {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// record updates b's consecutive success/failure counts with the outcome of
+// one probe and flips its health once a threshold is reached. It is only
+// called from the health checking goroutine for b.
+func (hc *HealthCheck) record(pool *Pool, b *Backend, err error) {
+	if err == nil {
+		b.checkFailures = 0
+		b.checkSuccesses++
+		if !b.Healthy() && b.checkSuccesses >= hc.HealthyThreshold {
+			b.setHealthy(true)
+			b.startWarming()
+			log.Printf("backend %s healthy again after %d successful checks", b.Addr, b.checkSuccesses)
+		}
+		return
+	}
+	b.checkSuccesses = 0
+	b.checkFailures++
+	if b.Healthy() && b.checkFailures >= hc.UnhealthyThreshold {
+		b.setHealthy(false)
+		ejectionsTotal.inc(pool.name, b.Addr, "health_check")
+		log.Printf("backend %s unhealthy after %d failed checks: %v", b.Addr, b.checkFailures, err)
+	}
+}
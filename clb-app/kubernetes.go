@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// The subset of the discovery.k8s.io/v1 EndpointSlice API the balancer reads.
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string                  `json:"addressType"`
+	Endpoints   []endpointSliceEndpoint `json:"endpoints"`
+	Ports       []struct {
+		Name     *string `json:"name"`
+		Port     *int32  `json:"port"`
+		Protocol *string `json:"protocol"`
+	} `json:"ports"`
+}
+
+type endpointSliceEndpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready       *bool `json:"ready"`
+		Terminating *bool `json:"terminating"`
+	} `json:"conditions"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSliceEvent struct {
+	Type   string        `json:"type"` // ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Object endpointSlice `json:"object"`
+}
+
+// endpointSliceWatch is an open watch stream. Next blocks until the next event
+// arrives or the stream ends.
+type endpointSliceWatch interface {
+	Next() (endpointSliceEvent, error)
+	Close() error
+}
+
+// endpointSliceClient lists and watches the EndpointSlices of one Service.
+// kubeClient talks to the API server; tests can substitute a fake.
+type endpointSliceClient interface {
+	List(ctx context.Context) (*endpointSliceList, error)
+	Watch(ctx context.Context, resourceVersion string) (endpointSliceWatch, error)
+}
+
+// errWatchExpired is returned when the API server no longer has the requested
+// resource version and the slices must be listed again.
+var errWatchExpired = errors.New("watch resource version expired")
+
+// kubeClient is a minimal in-cluster API client authenticated with the pod's
+// service account.
+type kubeClient struct {
+	host      string
+	namespace string
+	service   string
+	client    *http.Client
+}
+
+func newInClusterClient(namespace, service string) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster: KUBERNETES_SERVICE_HOST/PORT unset")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in service account ca.crt")
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return &kubeClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		service:   service,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}},
+	}, nil
+}
+
+func (c *kubeClient) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	// The token is re-read on every call because the kubelet rotates it.
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	query.Set("labelSelector", "kubernetes.io/service-name="+c.service)
+	u := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		c.host, url.PathEscape(c.namespace), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errWatchExpired
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET %s: %s: %s", u, resp.Status, body)
+	}
+	return resp, nil
+}
+
+func (c *kubeClient) List(ctx context.Context) (*endpointSliceList, error) {
+	resp, err := c.get(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *kubeClient) Watch(ctx context.Context, resourceVersion string) (endpointSliceWatch, error) {
+	resp, err := c.get(ctx, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kubeWatch{body: resp.Body, dec: json.NewDecoder(resp.Body)}, nil
+}
+
+type kubeWatch struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+}
+
+func (w *kubeWatch) Next() (endpointSliceEvent, error) {
+	var ev endpointSliceEvent
+	err := w.dec.Decode(&ev)
+	return ev, err
+}
+
+func (w *kubeWatch) Close() error { return w.body.Close() }
+
+// watchEndpointSlices keeps update informed of the ready addresses of the
+// Service's EndpointSlices until ctx is cancelled. portName selects the slice
+// port to use; if empty the first port is used.
+func watchEndpointSlices(ctx context.Context, client endpointSliceClient, portName string, update func([]*Backend)) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := syncEndpointSlices(ctx, client, portName, update)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errWatchExpired {
+			backoff = time.Second
+			continue
+		}
+		log.Printf("endpointslice watch: %v; retrying in %v", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// syncEndpointSlices lists the slices once and then follows the watch until
+// the watch fails or expires.
+func syncEndpointSlices(ctx context.Context, client endpointSliceClient, portName string, update func([]*Backend)) error {
+	list, err := client.List(ctx)
+	if err != nil {
+		return err
+	}
+	slices := make(map[string]endpointSlice, len(list.Items))
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	update(sliceBackends(slices, portName))
+
+	rv := list.Metadata.ResourceVersion
+	for {
+		w, err := client.Watch(ctx, rv)
+		if err != nil {
+			return err
+		}
+		rv, err = followWatch(w, slices, portName, update, rv)
+		w.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// followWatch applies events from w to slices until the stream ends and
+// returns the last resource version seen.
+func followWatch(w endpointSliceWatch, slices map[string]endpointSlice, portName string, update func([]*Backend), rv string) (string, error) {
+	for {
+		ev, err := w.Next()
+		if err != nil {
+			return rv, err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			slices[ev.Object.Metadata.Name] = ev.Object
+		case "DELETED":
+			delete(slices, ev.Object.Metadata.Name)
+		case "BOOKMARK":
+			rv = ev.Object.Metadata.ResourceVersion
+			continue
+		case "ERROR":
+			return rv, errWatchExpired
+		default:
+			continue
+		}
+		rv = ev.Object.Metadata.ResourceVersion
+		update(sliceBackends(slices, portName))
+	}
+}
+
+// sliceBackends flattens slices into one backend per ready endpoint address.
+// Endpoints that are terminating come back draining so that the pool stops
+// sending them new requests but lets the ones in flight finish.
+func sliceBackends(slices map[string]endpointSlice, portName string) []*Backend {
+	var backends []*Backend
+	seen := make(map[string]bool)
+	for _, s := range slices {
+		if s.AddressType != "IPv4" && s.AddressType != "IPv6" {
+			continue
+		}
+		port, ok := slicePort(s, portName)
+		if !ok {
+			continue
+		}
+		for _, ep := range s.Endpoints {
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			// A nil ready condition means unknown, which the API says to
+			// treat as ready.
+			ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			terminating := ep.Conditions.Terminating != nil && *ep.Conditions.Terminating
+			if !ready && !terminating {
+				continue
+			}
+			addr := net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port))
+			if !seen[addr] {
+				seen[addr] = true
+				b := &Backend{Addr: addr, Weight: 1}
+				if terminating {
+					b.state = backendDraining
+				}
+				backends = append(backends, b)
+			}
+		}
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Addr < backends[j].Addr })
+	return backends
+}
+
+func slicePort(s endpointSlice, name string) (int, bool) {
+	for _, p := range s.Ports {
+		if p.Port == nil || (p.Protocol != nil && *p.Protocol != "TCP") {
+			continue
+		}
+		if name == "" || (p.Name != nil && *p.Name == name) {
+			return int(*p.Port), true
+		}
+	}
+	if len(s.Ports) == 0 && name == "" {
+		return 80, true
+	}
+	return 0, false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSliceClient serves scripted lists and watches. Once the scripts run
+// out, List fails and Watch returns a stream that stays open until the
+// context is cancelled.
+type fakeSliceClient struct {
+	mu         sync.Mutex
+	lists      []*endpointSliceList
+	watches    []fakeWatchScript
+	watchedRVs []string
+}
+
+type fakeWatchScript struct {
+	err    error // returned by Watch itself, e.g. errWatchExpired for 410 Gone
+	events []endpointSliceEvent
+	end    error // returned by Next after the events; io.EOF if nil
+}
+
+func (c *fakeSliceClient) List(ctx context.Context) (*endpointSliceList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.lists) == 0 {
+		return nil, fmt.Errorf("unexpected list")
+	}
+	list := c.lists[0]
+	c.lists = c.lists[1:]
+	return list, nil
+}
+
+func (c *fakeSliceClient) Watch(ctx context.Context, resourceVersion string) (endpointSliceWatch, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watchedRVs = append(c.watchedRVs, resourceVersion)
+	if len(c.watches) == 0 {
+		return &fakeWatch{ctx: ctx, block: true}, nil
+	}
+	script := c.watches[0]
+	c.watches = c.watches[1:]
+	if script.err != nil {
+		return nil, script.err
+	}
+	return &fakeWatch{ctx: ctx, events: script.events, end: script.end}, nil
+}
+
+func (c *fakeSliceClient) rvs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.watchedRVs...)
+}
+
+type fakeWatch struct {
+	ctx    context.Context
+	events []endpointSliceEvent
+	end    error
+	block  bool
+}
+
+func (w *fakeWatch) Next() (endpointSliceEvent, error) {
+	if w.block {
+		<-w.ctx.Done()
+		return endpointSliceEvent{}, w.ctx.Err()
+	}
+	if len(w.events) == 0 {
+		if w.end != nil {
+			return endpointSliceEvent{}, w.end
+		}
+		return endpointSliceEvent{}, io.EOF
+	}
+	ev := w.events[0]
+	w.events = w.events[1:]
+	return ev, nil
+}
+
+func (w *fakeWatch) Close() error { return nil }
+
+type testEndpoint struct {
+	addr               string
+	ready, terminating bool
+}
+
+func testSlice(name, rv string, endpoints ...testEndpoint) endpointSlice {
+	var s endpointSlice
+	s.Metadata.Name, s.Metadata.ResourceVersion = name, rv
+	s.AddressType = "IPv4"
+	port, proto := int32(8080), "TCP"
+	s.Ports = append(s.Ports, struct {
+		Name     *string `json:"name"`
+		Port     *int32  `json:"port"`
+		Protocol *string `json:"protocol"`
+	}{Port: &port, Protocol: &proto})
+	for _, e := range endpoints {
+		ready, terminating := e.ready, e.terminating
+		var ep endpointSliceEndpoint
+		ep.Addresses = []string{e.addr}
+		ep.Conditions.Ready, ep.Conditions.Terminating = &ready, &terminating
+		s.Endpoints = append(s.Endpoints, ep)
+	}
+	return s
+}
+
+func testSliceList(rv string, slices ...endpointSlice) *endpointSliceList {
+	list := &endpointSliceList{Items: slices}
+	list.Metadata.ResourceVersion = rv
+	return list
+}
+
+func describeBackends(backends []*Backend) string {
+	var parts []string
+	for _, b := range backends {
+		parts = append(parts, b.Addr+"/"+b.State())
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestWatchEndpointSlices(t *testing.T) {
+	ready := func(addr string) testEndpoint { return testEndpoint{addr: addr, ready: true} }
+	client := &fakeSliceClient{
+		lists: []*endpointSliceList{
+			testSliceList("1", testSlice("web-a", "1",
+				ready("10.0.0.1"),
+				testEndpoint{addr: "10.0.0.2"},                    // not ready: dropped
+				testEndpoint{addr: "10.0.0.3", terminating: true}, // finishing its requests
+			)),
+			testSliceList("10", testSlice("web-a", "10", ready("10.0.0.4"))),
+			testSliceList("20", testSlice("web-a", "20", ready("10.0.0.5"))),
+		},
+		watches: []fakeWatchScript{
+			{events: []endpointSliceEvent{
+				{Type: "ADDED", Object: testSlice("web-b", "2", ready("10.0.1.1"))},
+				{Type: "MODIFIED", Object: testSlice("web-a", "3", testEndpoint{addr: "10.0.0.1"}, ready("10.0.0.2"))},
+				{Type: "DELETED", Object: testSlice("web-b", "4")},
+				{Type: "BOOKMARK", Object: testSlice("", "5")},
+			}},
+			// The stream ends normally and is resumed from the bookmark, then
+			// reports an error, which calls for a fresh list.
+			{events: []endpointSliceEvent{{Type: "ERROR"}}},
+			// 410 Gone: the version is too old, list again.
+			{err: errWatchExpired},
+		},
+	}
+
+	updates := make(chan string, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchEndpointSlices(ctx, client, "", func(backends []*Backend) { updates <- describeBackends(backends) })
+		close(done)
+	}()
+
+	want := []string{
+		"10.0.0.1:8080/active 10.0.0.3:8080/draining",
+		"10.0.0.1:8080/active 10.0.0.3:8080/draining 10.0.1.1:8080/active",
+		"10.0.0.2:8080/active 10.0.1.1:8080/active",
+		"10.0.0.2:8080/active",
+		"10.0.0.4:8080/active",
+		"10.0.0.5:8080/active",
+	}
+	for i, w := range want {
+		select {
+		case got := <-updates:
+			if got != w {
+				t.Errorf("update %d: got %q, want %q", i, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for update %d", i)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchEndpointSlices did not return after cancel")
+	}
+	select {
+	case got := <-updates:
+		t.Errorf("unexpected update %q", got)
+	default:
+	}
+	if got, want := client.rvs(), []string{"1", "5", "10", "20"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("watched from resource versions %v, want %v", got, want)
+	}
+}
+
+func TestSliceBackendsPort(t *testing.T) {
+	s := testSlice("web", "1", testEndpoint{addr: "10.0.0.1", ready: true})
+	name := "http"
+	s.Ports[0].Name = &name
+	slices := map[string]endpointSlice{"web": s}
+	if got := describeBackends(sliceBackends(slices, "http")); got != "10.0.0.1:8080/active" {
+		t.Errorf("named port: got %q", got)
+	}
+	if got := describeBackends(sliceBackends(slices, "metrics")); got != "" {
+		t.Errorf("missing port: got %q, want no backends", got)
+	}
+}
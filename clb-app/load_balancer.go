@@ -1,56 +1,310 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"io"
+	"log"
 	"math/rand"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-func getPodIPs() []string {
-	podIPsEnv := os.Getenv("POD_IPS")
-	return strings.Split(podIPsEnv, ",")
-}
+var (
+	pools             map[string]*Pool
+	retryPolicy       *RetryPolicy
+	timeouts          *Timeouts
+	streaming         *Streaming
+	accessLog         *accessLogger
+	tracer            *Tracer
+	upstreamTransport *http.Transport
+)
 
-func weightedChoice(choices []string, weights []float64) string {
+func weightedChoice(choices []*Backend) *Backend {
 	total := 0.0
-	for _, weight := range weights {
-		total += weight
+	for _, b := range choices {
+		total += b.effectiveWeight()
 	}
 	r := rand.Float64() * total
 	upto := 0.0
-	for i, choice := range choices {
-		if upto+weights[i] >= r {
+	for _, choice := range choices {
+		w := choice.effectiveWeight()
+		if w > 0 && upto+w >= r {
 			return choice
 		}
-		upto += weights[i]
+		upto += w
 	}
 	return choices[len(choices)-1]
 }
 
+// exchange records how one client request was served.
+type exchange struct {
+	pool     *Pool
+	backend  *Backend // the last backend tried, if any
+	attempts int
+	upstream time.Duration // spent waiting for response headers
+	span     *span
+}
+
 func loadBalance(w http.ResponseWriter, r *http.Request) {
-	podIPs := getPodIPs()
-	weights := []float64{0.5, 0.3, 0.2}
-	selectedPod := weightedChoice(podIPs, weights)
-	resp, err := http.Get(fmt.Sprintf("http://%s", selectedPod))
-	if err != nil {
-		http.Error(w, "Failed to reach pod", http.StatusInternalServerError)
+	start := time.Now()
+	atomic.AddInt64(&requestsInFlight, 1)
+	sw := &statusWriter{ResponseWriter: w}
+	ex := &exchange{span: tracer.startServerSpan(r, "proxy "+r.Method)}
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = body
+	}
+	defer func() {
+		atomic.AddInt64(&requestsInFlight, -1)
+		status := sw.status
+		if status == 0 && r.Context().Err() == context.Canceled {
+			status = statusClientClosedRequest
+		}
+		poolName := ""
+		if ex.pool != nil {
+			poolName = ex.pool.name
+		}
+		requestsTotal.inc(poolName, metricMethod(r), strconv.Itoa(status))
+
+		ex.span.set("http.method", r.Method)
+		ex.span.set("http.target", r.URL.RequestURI())
+		ex.span.set("http.status_code", status)
+		ex.span.set("clb.pool", poolName)
+		ex.span.set("clb.attempts", ex.attempts)
+		if status >= 500 {
+			ex.span.setError(http.StatusText(status))
+		}
+		ex.span.finish()
+
+		e := newAccessEntry(r, start, status, ex)
+		e.BytesIn, e.BytesOut = body.count(), sw.written
+		accessLog.log(e)
+	}()
+	proxyRequest(sw, r, ex)
+}
+
+// proxyRequest sends r to a backend of the pool its route selects, retrying
+// on other backends as the retry policy allows, and relays the response.
+func proxyRequest(w http.ResponseWriter, r *http.Request, ex *exchange) {
+	ensureRequestID(w, r)
+	pool, shadow := currentRouter.Load().(*Router).Match(r)
+	ex.pool = pool
+	if pool == nil {
+		writeError(w, r, http.StatusNotFound, "no_route", "No route matches the request")
 		return
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	client := r.Context()
+	ctx, cancel := context.WithCancel(client)
+	defer cancel()
+	r = r.WithContext(ctx)
+	upstreamTimeout := timeouts.startExchange(cancel)
+	defer upstreamTimeout.stop()
+	retryable, err := retryPolicy.prepareBody(r)
 	if err != nil {
-		http.Error(w, "Failed to read response", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, "bad_request_body", "The request body could not be read")
+		return
+	}
+	attempts := 1
+	if retryable {
+		attempts = retryPolicy.MaxAttempts
+	}
+	var deadline time.Time
+	if retryPolicy.Budget > 0 {
+		deadline = time.Now().Add(retryPolicy.Budget)
+	}
+
+	mirrored := shadow.start(r)
+
+	selected := pickBackend(r, pool, ex.span)
+	if selected == nil {
+		mirrored.primaryDone("error", 0)
+		writeError(w, r, http.StatusServiceUnavailable, "no_healthy_backend", "No healthy backend is available")
+		return
+	}
+	var tried []*Backend
+	for {
+		tried = append(tried, selected)
+		ex.backend, ex.attempts = selected, len(tried)
+
+		timeout := retryPolicy.PerTryTimeout
+		if !deadline.IsZero() {
+			if left := time.Until(deadline); timeout == 0 || left < timeout {
+				timeout = left
+			}
+		}
+		attempt := ex.span.child("upstream attempt", spanKindClient)
+		attempt.set("clb.backend", selected.Addr)
+		attempt.set("clb.attempt", len(tried))
+		attempt.set("clb.retry", len(tried) > 1)
+		if attempt != nil {
+			r.Header.Set(traceparentHeader, attempt.traceparent())
+		}
+		start := time.Now()
+		resp, done, err := sendAttempt(r, selected, timeout)
+		elapsed := time.Since(start)
+		ex.upstream += elapsed
+		upstreamDuration.observe(elapsed.Seconds(), pool.name, selected.Addr)
+		if err == nil {
+			if err = streaming.bufferResponse(resp); err != nil {
+				resp.Body.Close()
+				resp = nil
+			}
+		}
+		if client.Err() == nil {
+			// A client that went away says nothing about the backend.
+			failed := err != nil || resp.StatusCode >= 500
+			selected.recent.record(failed)
+			pool.RecordOutcome(selected, failed)
+		}
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		upstreamRequestsTotal.inc(pool.name, selected.Addr, metricMethod(r), code)
+		if err != nil {
+			attempt.setError(err.Error())
+		} else {
+			attempt.set("http.status_code", resp.StatusCode)
+			if resp.StatusCode >= 500 {
+				attempt.setError(resp.Status)
+			}
+		}
+
+		if len(tried) < attempts && r.Context().Err() == nil &&
+			(deadline.IsZero() || time.Now().Before(deadline)) &&
+			retryPolicy.shouldRetry(resp, err) {
+			if next := pickBackend(r, pool, ex.span, tried...); next != nil {
+				if err == nil {
+					resp.Body.Close()
+				}
+				done()
+				attempt.finish()
+				log.Printf("retrying %s %s: attempt %d on %s failed: %s", r.Method, r.URL.Path, len(tried), selected.Addr, attemptResult(resp, err))
+				retriesTotal.inc(pool.name)
+				selected = next
+				continue
+			}
+		}
+
+		if err != nil {
+			mirrored.primaryDone("error", ex.upstream)
+			done()
+			attempt.finish()
+			if upstreamTimeout.Expired() {
+				err = fmt.Errorf("%w: no response within %v", context.DeadlineExceeded, timeouts.Upstream)
+			}
+			writeUpstreamError(w, r.WithContext(client), selected, err)
+			return
+		}
+		mirrored.primaryDone(strconv.Itoa(resp.StatusCode), ex.upstream)
+		pool.affinity.pin(w, r, pool.name, selected)
+		resp.Body = upstreamTimeout.stream(resp.Body, timeouts.StreamIdle)
+		err = copyResponse(newDeadlineWriter(w, timeouts.Write), resp, streaming.flushInterval(resp))
+		resp.Body.Close()
+		done()
+		attempt.finish()
+		if err != nil {
+			if upstreamTimeout.Expired() {
+				err = fmt.Errorf("timed out: %v", err)
+			}
+			log.Printf("copying response from %s: %v", selected.Addr, err)
+			// The status line is already out; abort the connection so the
+			// client does not mistake a truncated body for a complete one.
+			panic(http.ErrAbortHandler)
+		}
 		return
 	}
-	w.Write(body)
+}
+
+// pickBackend asks pool for a backend for r not in exclude, recording the
+// decision as a span below parent.
+func pickBackend(r *http.Request, pool *Pool, parent *span, exclude ...*Backend) *Backend {
+	sp := parent.child("select backend", spanKindInternal)
+	b := pool.Pick(r, exclude...)
+	sp.set("clb.pool", pool.name)
+	sp.set("clb.excluded", len(exclude))
+	if b != nil {
+		sp.set("clb.backend", b.Addr)
+		sp.set("clb.weight", pool.Weight(b))
+	} else {
+		sp.setError("no selectable backend")
+	}
+	sp.finish()
+	return b
+}
+
+func attemptResult(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
 }
 
 func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON configuration `file`")
+	validateOnly := flag.Bool("validate-config", false, "check the configuration and exit")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if *validateOnly {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+		return
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration in %q: %v", *configFile, err)
+	}
+
 	rand.Seed(time.Now().UnixNano())
-	http.HandleFunc("/", loadBalance)
-	http.ListenAndServe(":80", nil)
+	retryPolicy = &cfg.Retries
+	timeouts = &cfg.Timeouts
+	streaming = &cfg.Streaming
+	upstreamTransport = timeouts.newTransport()
+	if accessLog, err = newAccessLogger(cfg.AccessLog); err != nil {
+		log.Fatalf("access log: %v", err)
+	}
+	tracer = newTracer(cfg.Tracing)
+
+	ctx := context.Background()
+	pools = make(map[string]*Pool, len(cfg.Pools))
+	for _, pc := range cfg.Pools {
+		p, err := startPool(ctx, pc)
+		if err != nil {
+			log.Fatalf("pool %s: %v", pc.Name, err)
+		}
+		pools[pc.Name] = p
+	}
+	splits := buildSplits(cfg.Splits, pools, nil)
+	currentRouter.Store(newRouter(cfg.Routes, pools, splits, pools[cfg.fallbackPool()]))
+	if *configFile != "" {
+		go watchConfig(ctx, *configFile, cfg.ReloadInterval, applyConfig)
+	}
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("/livez", livez)
+	admin.HandleFunc("/readyz", readyz)
+	admin.HandleFunc("/metrics", metricsHandler)
+	api, err := newAdminAPI(cfg.Admin)
+	if err != nil {
+		log.Fatalf("admin API: %v", err)
+	}
+	if api != nil {
+		admin.Handle("/api/", api)
+	} else {
+		log.Printf("admin API disabled: set ADMIN_TOKEN or admin.token_file to enable it")
+	}
+
+	var servers []*http.Server
+	for _, l := range cfg.Listeners {
+		servers = append(servers, timeouts.newServer(l.Address, http.HandlerFunc(loadBalance)))
+	}
+	cfg.Shutdown.serveUntilSignal(servers, timeouts.newServer(cfg.Admin.Address, admin))
+	tracer.Close()
 }
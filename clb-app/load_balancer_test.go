@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTestProxy loads the configuration text cfg and installs it in the
+// proxy's global state the way main does, without starting any servers.
+// Discovery and health checks stop when the test ends.
+func setupTestProxy(t *testing.T, text string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	retryPolicy = &cfg.Retries
+	timeouts = &cfg.Timeouts
+	streaming = &cfg.Streaming
+	upstreamTransport = timeouts.newTransport()
+	if accessLog, err = newAccessLogger(cfg.AccessLog); err != nil {
+		t.Fatal(err)
+	}
+	tracer = newTracer(cfg.Tracing)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pools = make(map[string]*Pool, len(cfg.Pools))
+	for _, pc := range cfg.Pools {
+		p, err := startPool(ctx, pc)
+		if err != nil {
+			t.Fatalf("pool %s: %v", pc.Name, err)
+		}
+		pools[pc.Name] = p
+	}
+	splits := buildSplits(cfg.Splits, pools, nil)
+	currentRouter.Store(newRouter(cfg.Routes, pools, splits, pools[cfg.fallbackPool()]))
+	return cfg
+}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
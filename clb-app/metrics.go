@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The balancer's metrics, served on the admin listener at /metrics in the
+// Prometheus text format. Counters and histograms are updated as requests are
+// served; gauges are read from the pools at scrape time.
+var (
+	requestsTotal = newCounterVec("clb_requests_total",
+		"Client requests served, by pool, method and response status code; method is \"other\" for nonstandard methods.",
+		"pool", "method", "code")
+	upstreamRequestsTotal = newCounterVec("clb_upstream_requests_total",
+		"Attempts sent to backends, by backend, method and status code; code is \"error\" if no response arrived.",
+		"pool", "backend", "method", "code")
+	upstreamDuration = newHistogramVec("clb_upstream_duration_seconds",
+		"Time from sending an attempt to a backend until its response headers arrived or it failed.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		"pool", "backend")
+	selectionsTotal = newCounterVec("clb_backend_selections_total",
+		"Times the balancing strategy picked each backend, including picks for retries.",
+		"pool", "backend")
+	retriesTotal = newCounterVec("clb_retries_total",
+		"Attempts retried on another backend.",
+		"pool")
+	drainsTotal = newCounterVec("clb_drains_total",
+		"Backends removed after draining, by result: completed once idle, or timeout.",
+		"pool", "result")
+	splitRequestsTotal = newCounterVec("clb_split_requests_total",
+		"Requests a traffic split sent to each pool, by reason: weight or pin.",
+		"split", "pool", "reason")
+	mirrorRequestsTotal = newCounterVec("clb_mirror_requests_total",
+		"Shadow requests sent to a mirror pool, by status code; code is \"error\" if no response arrived.",
+		"pool", "code")
+	mirrorsSkippedTotal = newCounterVec("clb_mirror_skipped_total",
+		"Sampled requests that were not mirrored, by reason: body_too_large, overloaded or no_healthy_backend.",
+		"pool", "reason")
+	mirrorComparisonsTotal = newCounterVec("clb_mirror_comparisons_total",
+		"Mirrored requests by the status codes of the primary and the shadow response.",
+		"pool", "primary_code", "shadow_code")
+	mirrorDuration = newHistogramVec("clb_mirror_duration_seconds",
+		"Time from sending a shadow request until its response headers arrived or it failed.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		"pool")
+	mirrorLatencyRatio = newHistogramVec("clb_mirror_latency_ratio",
+		"Shadow response header latency divided by the primary's, for requests both answered.",
+		[]float64{.25, .5, .8, .9, 1, 1.1, 1.25, 2, 4},
+		"pool")
+	ejectionsTotal = newCounterVec("clb_ejections_total",
+		"Backends taken out of selection, by reason: consecutive_errors, error_rate or health_check.",
+		"pool", "backend", "reason")
+
+	requestsInFlight int64 // client requests being served, accessed atomically
+)
+
+// metricsHandler serves every metric in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, c := range []*counterVec{requestsTotal, upstreamRequestsTotal, selectionsTotal, retriesTotal, ejectionsTotal, drainsTotal, splitRequestsTotal,
+		mirrorRequestsTotal, mirrorsSkippedTotal, mirrorComparisonsTotal} {
+		c.write(bw)
+	}
+	for _, h := range []*histogramVec{upstreamDuration, mirrorDuration, mirrorLatencyRatio} {
+		h.write(bw)
+	}
+
+	writeHeader(bw, "clb_requests_in_flight", "gauge", "Client requests currently being served.")
+	fmt.Fprintf(bw, "clb_requests_in_flight %d\n", atomic.LoadInt64(&requestsInFlight))
+
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, g := range []struct {
+		name, help string
+		value      func(*Pool, *Backend) float64
+	}{
+		{"clb_backend_in_flight", "Requests currently outstanding on each backend.",
+			func(_ *Pool, b *Backend) float64 { return float64(atomic.LoadInt64(&b.inflight)) }},
+		{"clb_backend_healthy", "1 if the backend passes active health checks, 0 otherwise.",
+			func(_ *Pool, b *Backend) float64 { return boolValue(b.Healthy()) }},
+		{"clb_backend_ejected", "1 if outlier detection currently ejects the backend, 0 otherwise.",
+			func(_ *Pool, b *Backend) float64 { return boolValue(b.Ejected(now)) }},
+		{"clb_backend_draining", "1 if the backend is draining: no new requests, in-flight ones finishing.",
+			func(_ *Pool, b *Backend) float64 { return boolValue(b.Draining()) }},
+		{"clb_backend_drain_seconds", "How long a draining backend has been draining, 0 if it is not.",
+			func(_ *Pool, b *Backend) float64 { return b.drainingFor(now).Seconds() }},
+		{"clb_backend_weight", "Configured or discovered weight of each backend.",
+			(*Pool).Weight},
+		{"clb_backend_effective_weight", "Weight the backend is balanced with, below clb_backend_weight while slow-starting.",
+			(*Pool).EffectiveWeight},
+	} {
+		writeHeader(bw, g.name, "gauge", g.help)
+		for _, name := range names {
+			p := pools[name]
+			for _, b := range p.Backends() {
+				fmt.Fprintf(bw, "%s%s %s\n", g.name, formatLabels([]string{"pool", "backend"}, []string{name, b.Addr}), formatFloat(g.value(p, b)))
+			}
+		}
+	}
+
+	splits := currentRouter.Load().(*Router).splits
+	splitNames := make([]string, 0, len(splits))
+	for name := range splits {
+		splitNames = append(splitNames, name)
+	}
+	sort.Strings(splitNames)
+	writeHeader(bw, "clb_split_percent", "gauge", "Share of a traffic split's weighted requests each pool gets, in percent.")
+	for _, name := range splitNames {
+		shares := splits[name].Weights()
+		targets := make([]string, 0, len(shares))
+		for pool := range shares {
+			targets = append(targets, pool)
+		}
+		sort.Strings(targets)
+		for _, pool := range targets {
+			fmt.Fprintf(bw, "clb_split_percent%s %s\n", formatLabels([]string{"split", "pool"}, []string{name, pool}), formatFloat(shares[pool]))
+		}
+	}
+}
+
+// metricMethod returns the method label for r: its method if it is one of
+// the standard ones, else "other", so that clients sending arbitrary methods
+// cannot create unbounded series.
+func metricMethod(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return r.Method
+	}
+	return "other"
+}
+
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	count  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+}
+
+// inc adds one to the series with the given label values, which must match
+// the vector's labels in number and order.
+func (c *counterVec) inc(values ...string) {
+	key := seriesKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.series[key]
+	if s == nil {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.count++
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, "counter", c.help)
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.count))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending, without +Inf
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := seriesKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, "histogram", h.help)
+	labels := append(append([]string(nil), h.labels...), "le")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		values := append(append([]string(nil), s.values...), "")
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = formatFloat(le)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func seriesKey(values []string) string { return strings.Join(values, "\xff") }
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricMethod(t *testing.T) {
+	for method, want := range map[string]string{
+		"GET":      "GET",
+		"PATCH":    "PATCH",
+		"OPTIONS":  "OPTIONS",
+		"get":      "other",
+		"PROPFIND": "other",
+		"X-RANDOM": "other",
+	} {
+		if got := metricMethod(httptest.NewRequest(method, "/", nil)); got != want {
+			t.Errorf("metricMethod(%s) = %q, want %q", method, got, want)
+		}
+	}
+}
+
+// counterValue returns the count of c's series with the given label values.
+func counterValue(c *counterVec, values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.series[seriesKey(values)]; s != nil {
+		return s.count
+	}
+	return 0
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig sends a copy of a share of a route's requests to a shadow
+// pool. Shadow responses are discarded; only their status codes and
+// latencies are recorded, next to those of the primary responses.
+type MirrorConfig struct {
+	Pool      string        `json:"pool"`
+	Percent   float64       `json:"percent"`    // of the route's requests
+	BodyLimit int64         `json:"body_limit"` // requests with larger bodies are not mirrored
+	Timeout   time.Duration `json:"timeout"`    // whole shadow exchange, body included
+}
+
+func (mc *MirrorConfig) setDefaults() {
+	mc.Percent = 100
+	mc.BodyLimit = 1 << 20
+	mc.Timeout = 10 * time.Second
+}
+
+func (mc *MirrorConfig) validate(v *validator, path string, pools map[string]bool) {
+	if !pools[mc.Pool] {
+		v.errorf(path+".pool", "unknown pool %q", mc.Pool)
+	}
+	if mc.Percent < 0 || mc.Percent > 100 {
+		v.errorf(path+".percent", "must be between 0 and 100, got %v", mc.Percent)
+	}
+	if mc.BodyLimit < 0 {
+		v.errorf(path+".body_limit", "must not be negative")
+	}
+	if mc.Timeout <= 0 {
+		v.errorf(path+".timeout", "must be positive")
+	}
+}
+
+// maxMirrorsInFlight bounds the shadow requests outstanding per shadow pool,
+// so a slow one cannot pile up goroutines and buffered bodies. Requests
+// beyond it are not mirrored.
+const maxMirrorsInFlight = 256
+
+// mirrorsInFlight counts the shadow requests outstanding per shadow pool
+// name. It outlives the mirrors, which every config reload builds anew, so
+// that requests still in flight from before a reload keep counting.
+var mirrorsInFlight = struct {
+	sync.Mutex
+	counts map[string]*int64 // accessed atomically
+}{counts: make(map[string]*int64)}
+
+// mirrorInFlight returns the in-flight count of the named shadow pool.
+func mirrorInFlight(pool string) *int64 {
+	mirrorsInFlight.Lock()
+	defer mirrorsInFlight.Unlock()
+	n := mirrorsInFlight.counts[pool]
+	if n == nil {
+		n = new(int64)
+		mirrorsInFlight.counts[pool] = n
+	}
+	return n
+}
+
+// mirror is the running form of a route's MirrorConfig. A nil *mirror
+// mirrors nothing.
+type mirror struct {
+	MirrorConfig
+	pool     *Pool
+	inflight *int64 // shared by the mirrors of the pool, accessed atomically
+}
+
+func newMirror(mc *MirrorConfig, pools map[string]*Pool) *mirror {
+	if mc == nil {
+		return nil
+	}
+	return &mirror{MirrorConfig: *mc, pool: pools[mc.Pool], inflight: mirrorInFlight(mc.Pool)}
+}
+
+// mirrorRequest is one shadow request, waiting to be compared with the
+// primary one.
+type mirrorRequest struct {
+	primary chan primaryResult
+}
+
+type primaryResult struct {
+	code     string        // status code, or "error" if no backend answered
+	upstream time.Duration // spent waiting for response headers
+}
+
+// start sends a copy of r to the shadow pool if r is sampled, returning the
+// request to report the primary result to, or nil. Bodies up to the limit
+// are buffered so that both copies can be sent.
+func (m *mirror) start(r *http.Request) *mirrorRequest {
+	if m == nil || rand.Float64()*100 >= m.Percent {
+		return nil
+	}
+	if r.GetBody == nil && r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if r.ContentLength > m.BodyLimit {
+			mirrorsSkippedTotal.inc(m.pool.name, "body_too_large")
+			return nil
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, m.BodyLimit+1))
+		if err != nil || int64(len(buf)) > m.BodyLimit {
+			// Let the primary request see the whole body, or the error.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+			mirrorsSkippedTotal.inc(m.pool.name, "body_too_large")
+			return nil
+		}
+		r.Body.Close()
+		r.ContentLength = int64(len(buf))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+		r.Body, _ = r.GetBody()
+	}
+	if atomic.AddInt64(m.inflight, 1) > maxMirrorsInFlight {
+		atomic.AddInt64(m.inflight, -1)
+		mirrorsSkippedTotal.inc(m.pool.name, "overloaded")
+		return nil
+	}
+
+	// The shadow request must outlive the client's, so it gets its own
+	// context, bounded by the mirror's timeout until its body has been read.
+	// Upstream requests keep the client's Host, so the "-shadow" suffix
+	// reaches the shadow backends and lets them tell mirrored requests apart.
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	shadow := r.Clone(ctx)
+	shadow.Host = r.Host + "-shadow"
+	shadow.Header.Del(traceparentHeader)
+	if r.GetBody != nil {
+		shadow.Body, _ = r.GetBody()
+	}
+	mr := &mirrorRequest{primary: make(chan primaryResult, 1)}
+	go func() {
+		defer atomic.AddInt64(m.inflight, -1)
+		m.send(shadow, cancel, mr)
+	}()
+	return mr
+}
+
+// mirrorCompareWait bounds how long a finished shadow request waits for the
+// primary one to get its response headers.
+const mirrorCompareWait = time.Minute
+
+// send sends the shadow request and records how it went, next to the primary
+// result once that arrives. cancel releases the shadow's context.
+func (m *mirror) send(shadow *http.Request, cancel context.CancelFunc, mr *mirrorRequest) {
+	defer cancel()
+	pool := m.pool.name
+	b := m.pool.Pick(shadow)
+	if b == nil {
+		mirrorsSkippedTotal.inc(pool, "no_healthy_backend")
+		return
+	}
+	start := time.Now()
+	// The context's deadline bounds the whole exchange, headers included.
+	resp, done, err := sendAttempt(shadow, b, 0)
+	elapsed := time.Since(start)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		done()
+		cancel()
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	b.recent.record(failed)
+	m.pool.RecordOutcome(b, failed)
+	mirrorRequestsTotal.inc(pool, code)
+	mirrorDuration.observe(elapsed.Seconds(), pool)
+
+	select {
+	case p := <-mr.primary:
+		mirrorComparisonsTotal.inc(pool, p.code, code)
+		if err == nil && p.code != "error" && p.upstream > 0 {
+			mirrorLatencyRatio.observe(float64(elapsed)/float64(p.upstream), pool)
+		}
+	case <-time.After(mirrorCompareWait):
+	}
+}
+
+// primaryDone reports how the primary request went, once its response
+// headers have arrived or it has failed.
+func (mr *mirrorRequest) primaryDone(code string, upstream time.Duration) {
+	if mr == nil {
+		return
+	}
+	select {
+	case mr.primary <- primaryResult{code, upstream}:
+	default:
+	}
+}
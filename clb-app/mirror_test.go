@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMirrorTimeout checks that a shadow backend that never finishes its
+// response body is cut off after the mirror's timeout, and that it sees the
+// client's host with the shadow suffix.
+func TestMirrorTimeout(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary")
+	}))
+	defer primary.Close()
+	hosts := make(chan string, 1)
+	cut := make(chan time.Duration, 1)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		start := time.Now()
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			cut <- time.Since(start)
+		case <-release:
+		}
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	setupTestProxy(t, fmt.Sprintf(`
+pools:
+  - name: web
+    backends:
+      - address: %s
+  - name: shadow
+    backends:
+      - address: %s
+routes:
+  - path_prefix: /
+    pool: web
+    mirror:
+      pool: shadow
+      timeout: 200ms
+timeouts:
+  upstream: 0
+access_log:
+  output: "off"
+`, strings.TrimPrefix(primary.URL, "http://"), strings.TrimPrefix(shadow.URL, "http://")))
+
+	req := httptest.NewRequest("GET", "http://shop.example.com/", nil)
+	w := httptest.NewRecorder()
+	loadBalance(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "primary" {
+		t.Fatalf("primary response: %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case host := <-hosts:
+		if host != "shop.example.com-shadow" {
+			t.Errorf("shadow host = %q, want shop.example.com-shadow", host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request never arrived")
+	}
+	select {
+	case d := <-cut:
+		if d > 2*time.Second {
+			t.Errorf("shadow cut off after %v, want about 200ms", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow response body was never cut off")
+	}
+}
+
+// TestMirrorInFlightSurvivesReload checks that the cap on shadow requests
+// still counts the ones sent before a reload rebuilt the mirrors.
+func TestMirrorInFlightSurvivesReload(t *testing.T) {
+	pool, err := newPool("reload-shadow", "round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools := map[string]*Pool{"reload-shadow": pool}
+	mc := &MirrorConfig{}
+	mc.setDefaults()
+	mc.Pool = "reload-shadow"
+
+	before := newMirror(mc, pools)
+	atomic.StoreInt64(before.inflight, maxMirrorsInFlight)
+	defer atomic.StoreInt64(before.inflight, 0)
+
+	after := newMirror(mc, pools)
+	skipped := counterValue(mirrorsSkippedTotal, "reload-shadow", "overloaded")
+	if mr := after.start(httptest.NewRequest("GET", "/", nil)); mr != nil {
+		t.Fatal("mirrored a request beyond the in-flight cap after a reload")
+	}
+	if got := counterValue(mirrorsSkippedTotal, "reload-shadow", "overloaded") - skipped; got != 1 {
+		t.Errorf("counted %v overloaded skips, want 1", got)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetection ejects backends based on the outcome of proxied requests,
+// much like Envoy's outlier detection. A request fails when the upstream
+// cannot be reached, times out or answers with a 5xx status.
+type OutlierDetection struct {
+	ConsecutiveErrors  int           `json:"consecutive_errors"` // failures in a row that eject a backend, 0 disables
+	ErrorRate          float64       `json:"error_rate"`         // failure ratio per interval that ejects a backend, 0 disables
+	MinRequests        int           `json:"min_requests"`       // requests needed in an interval before ErrorRate applies
+	Interval           time.Duration `json:"interval"`
+	BaseEjectionTime   time.Duration `json:"base_ejection_time"` // doubled for each repeated ejection
+	MaxEjectionTime    time.Duration `json:"max_ejection_time"`
+	MaxEjectionPercent int           `json:"max_ejection_percent"` // share of the pool that may be ejected at once
+}
+
+// outlierStats is a backend's passive failure tracking.
+type outlierStats struct {
+	mu          sync.Mutex
+	consecutive int // failures in a row
+	requests    int // requests in the current interval
+	failures    int // failures in the current interval
+	ejections   int // recent ejections, drives the ejection time
+}
+
+func (od *OutlierDetection) setDefaults() {
+	od.ConsecutiveErrors = 5
+	od.MinRequests = 20
+	od.Interval = 10 * time.Second
+	od.BaseEjectionTime = 30 * time.Second
+	od.MaxEjectionTime = 5 * time.Minute
+	od.MaxEjectionPercent = 10
+}
+
+// applyEnv applies the OUTLIER_* overrides.
+func (od *OutlierDetection) applyEnv() error {
+	var err error
+	if od.ConsecutiveErrors, err = envNonNegInt("OUTLIER_CONSECUTIVE_ERRORS", od.ConsecutiveErrors); err != nil {
+		return err
+	}
+	if od.ErrorRate, err = envFloat("OUTLIER_ERROR_RATE", od.ErrorRate); err != nil {
+		return err
+	}
+	if od.MinRequests, err = envInt("OUTLIER_MIN_REQUESTS", od.MinRequests); err != nil {
+		return err
+	}
+	if od.Interval, err = envDuration("OUTLIER_INTERVAL", od.Interval); err != nil {
+		return err
+	}
+	if od.BaseEjectionTime, err = envDuration("OUTLIER_BASE_EJECTION_TIME", od.BaseEjectionTime); err != nil {
+		return err
+	}
+	if od.MaxEjectionTime, err = envDuration("OUTLIER_MAX_EJECTION_TIME", od.MaxEjectionTime); err != nil {
+		return err
+	}
+	if od.MaxEjectionPercent, err = envNonNegInt("OUTLIER_MAX_EJECTION_PERCENT", od.MaxEjectionPercent); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (od *OutlierDetection) validate(v *validator, path string) {
+	if od.ConsecutiveErrors < 0 {
+		v.errorf(path+".consecutive_errors", "must not be negative")
+	}
+	if od.ErrorRate < 0 || od.ErrorRate > 1 {
+		v.errorf(path+".error_rate", "must be between 0 and 1, got %v", od.ErrorRate)
+	}
+	if od.MinRequests < 1 {
+		v.errorf(path+".min_requests", "must be at least 1")
+	}
+	if od.Interval <= 0 {
+		v.errorf(path+".interval", "must be positive")
+	}
+	if od.BaseEjectionTime <= 0 {
+		v.errorf(path+".base_ejection_time", "must be positive")
+	}
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		v.errorf(path+".max_ejection_time", "must not be shorter than base_ejection_time")
+	}
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		v.errorf(path+".max_ejection_percent", "must be between 0 and 100, got %d", od.MaxEjectionPercent)
+	}
+}
+
+// Ejected reports whether outlier detection currently keeps b out of
+// selection.
+func (b *Backend) Ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&b.ejectedUntil)
+}
+
+// ejectionTime is the ejection length after n consecutive ejections.
+func (od *OutlierDetection) ejectionTime(n int) time.Duration {
+	d := od.BaseEjectionTime
+	for i := 1; i < n && d < od.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+	return d
+}
+
+// RecordOutcome feeds the result of one proxied request to b into outlier
+// detection.
+func (p *Pool) RecordOutcome(b *Backend, failed bool) {
+	od := p.outlier
+	if od == nil {
+		return
+	}
+	s := &b.outlier
+	s.mu.Lock()
+	s.requests++
+	if !failed {
+		s.consecutive = 0
+		s.mu.Unlock()
+		return
+	}
+	s.failures++
+	s.consecutive++
+	eject := od.ConsecutiveErrors > 0 && s.consecutive >= od.ConsecutiveErrors
+	s.mu.Unlock()
+
+	if eject {
+		p.eject(b, "consecutive_errors", fmt.Sprintf("%d consecutive failures", od.ConsecutiveErrors))
+	}
+}
+
+// eject takes b out of selection unless that would exceed the maximum
+// ejection percentage. At least one backend may always be ejected. cause is
+// the metrics label for reason.
+func (p *Pool) eject(b *Backend, cause, reason string) {
+	p.ejectMu.Lock()
+	defer p.ejectMu.Unlock()
+
+	now := time.Now()
+	if b.Ejected(now) {
+		return
+	}
+	backends := p.Backends()
+	ejected := 0
+	for _, other := range backends {
+		if other.Ejected(now) {
+			ejected++
+		}
+	}
+	allowed := len(backends) * p.outlier.MaxEjectionPercent / 100
+	if allowed < 1 {
+		allowed = 1
+	}
+	if ejected >= allowed {
+		log.Printf("backend %s is an outlier (%s) but %d of %d backends are already ejected", b.Addr, reason, ejected, len(backends))
+		return
+	}
+
+	s := &b.outlier
+	s.mu.Lock()
+	s.ejections++
+	s.consecutive = 0
+	d := p.outlier.ejectionTime(s.ejections)
+	s.mu.Unlock()
+	atomic.StoreInt64(&b.ejectedUntil, now.Add(d).UnixNano())
+	ejectionsTotal.inc(p.name, b.Addr, cause)
+	log.Printf("backend %s ejected for %v: %s", b.Addr, d, reason)
+}
+
+// runOutlierSweeps evaluates per-interval error rates and lets the ejection
+// time of backends that behaved since their last ejection decay.
+func (p *Pool) runOutlierSweeps(ctx context.Context) {
+	od := p.outlier
+	ticker := time.NewTicker(od.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		for _, b := range p.Backends() {
+			s := &b.outlier
+			s.mu.Lock()
+			requests, failures := s.requests, s.failures
+			s.requests, s.failures = 0, 0
+			if failures == 0 && s.ejections > 0 && !b.Ejected(now) {
+				s.ejections--
+			}
+			s.mu.Unlock()
+
+			if od.ErrorRate > 0 && requests >= od.MinRequests {
+				if rate := float64(failures) / float64(requests); rate >= od.ErrorRate {
+					p.eject(b, "error_rate", fmt.Sprintf("error rate %.0f%% over %d requests", rate*100, requests))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// Picker selects one backend out of a non-empty candidate list.
+type Picker interface {
+	Pick(candidates []*Backend) *Backend
+}
+
+// newPicker returns the built-in picker registered under name.
+func newPicker(name string) (Picker, error) {
+	switch name {
+	case "", "weighted-random":
+		return weightedRandomPicker{}, nil
+	case "round-robin":
+		return &roundRobinPicker{current: make(map[*Backend]float64)}, nil
+	case "least-requests":
+		return leastRequestsPicker{}, nil
+	case "p2c":
+		return p2cPicker{}, nil
+	case "ring-hash":
+		return newRingHashPicker(), nil
+	case "maglev":
+		return newMaglevPicker(), nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", name)
+}
+
+// weightedRandomPicker picks each backend with probability proportional to
+// its weight.
+type weightedRandomPicker struct{}
+
+func (weightedRandomPicker) Pick(candidates []*Backend) *Backend {
+	return weightedChoice(candidates)
+}
+
+// roundRobinPicker is nginx's smooth weighted round-robin: every pick adds
+// each backend's weight to its running score, then selects the highest score
+// and subtracts the total weight from it.
+type roundRobinPicker struct {
+	mu      sync.Mutex
+	current map[*Backend]float64
+}
+
+func (p *roundRobinPicker) Pick(candidates []*Backend) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *Backend
+	total := 0.0
+	for _, b := range candidates {
+		w := b.effectiveWeight()
+		p.current[b] += w
+		total += w
+		if best == nil || p.current[b] > p.current[best] {
+			best = b
+		}
+	}
+	p.current[best] -= total
+
+	// Forget backends that are no longer candidates.
+	if len(p.current) > len(candidates) {
+		live := make(map[*Backend]bool, len(candidates))
+		for _, b := range candidates {
+			live[b] = true
+		}
+		for b := range p.current {
+			if !live[b] {
+				delete(p.current, b)
+			}
+		}
+	}
+	return best
+}
+
+// leastRequestsPicker picks the backend with the fewest outstanding requests
+// relative to its weight. Ties are broken at random.
+type leastRequestsPicker struct{}
+
+func (leastRequestsPicker) Pick(candidates []*Backend) *Backend {
+	var best *Backend
+	bestScore, ties := 0.0, 0
+	for _, b := range candidates {
+		score := loadScore(b)
+		switch {
+		case best == nil || score < bestScore:
+			best, bestScore, ties = b, score, 1
+		case score == bestScore:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = b
+			}
+		}
+	}
+	return best
+}
+
+// p2cPicker samples two backends by weight and keeps the less loaded one.
+type p2cPicker struct{}
+
+func (p2cPicker) Pick(candidates []*Backend) *Backend {
+	a, b := weightedChoice(candidates), weightedChoice(candidates)
+	if loadScore(b) < loadScore(a) {
+		return b
+	}
+	return a
+}
+
+// loadScore is the number of outstanding requests scaled by weight, so a
+// backend with twice the weight is expected to carry twice the requests.
+func loadScore(b *Backend) float64 {
+	inflight := float64(atomic.LoadInt64(&b.inflight))
+	w := b.effectiveWeight()
+	if w == 0 {
+		return inflight + 1e12
+	}
+	return (inflight + 1) / w
+}
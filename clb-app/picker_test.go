@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func testBackends(weights ...float64) []*Backend {
+	backends := make([]*Backend, len(weights))
+	for i, w := range weights {
+		backends[i] = &Backend{Addr: string(rune('a' + i)), Weight: w}
+	}
+	return backends
+}
+
+// checkShares fails t unless each backend got its share of the total weight
+// within tolerance, as a fraction of all picks.
+func checkShares(t *testing.T, backends []*Backend, picks map[*Backend]int, n int, tolerance float64) {
+	t.Helper()
+	total := 0.0
+	for _, b := range backends {
+		total += b.Weight
+	}
+	for _, b := range backends {
+		want := b.Weight / total
+		got := float64(picks[b]) / float64(n)
+		if math.Abs(got-want) > tolerance {
+			t.Errorf("backend %s (weight %v): got %.3f of picks, want %.3f±%.3f", b.Addr, b.Weight, got, want, tolerance)
+		}
+	}
+}
+
+// pickIdle picks n times with no requests outstanding.
+func pickIdle(p Picker, backends []*Backend, n int) map[*Backend]int {
+	picks := make(map[*Backend]int)
+	for i := 0; i < n; i++ {
+		picks[p.Pick(backends)]++
+	}
+	return picks
+}
+
+// pickUnderLoad picks n times while keeping about outstanding requests in
+// flight, completing a random one after each pick, so that the load-aware
+// pickers see their choices reflected in the in-flight counts.
+func pickUnderLoad(p Picker, backends []*Backend, n, outstanding int) map[*Backend]int {
+	picks := make(map[*Backend]int)
+	var inflight []*Backend
+	for i := 0; i < n; i++ {
+		b := p.Pick(backends)
+		picks[b]++
+		atomic.AddInt64(&b.inflight, 1)
+		inflight = append(inflight, b)
+		if len(inflight) > outstanding {
+			j := rand.Intn(len(inflight))
+			atomic.AddInt64(&inflight[j].inflight, -1)
+			inflight[j] = inflight[len(inflight)-1]
+			inflight = inflight[:len(inflight)-1]
+		}
+	}
+	return picks
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	backends := testBackends(5, 3, 2)
+	const n = 100000
+	checkShares(t, backends, pickIdle(weightedRandomPicker{}, backends, n), n, 0.01)
+}
+
+func TestWeightedRandomSkipsZeroWeight(t *testing.T) {
+	backends := testBackends(1, 0, 1)
+	if picks := pickIdle(weightedRandomPicker{}, backends, 10000); picks[backends[1]] != 0 {
+		t.Errorf("backend with weight 0 got %d picks", picks[backends[1]])
+	}
+}
+
+func TestRoundRobinSequence(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	p, _ := newPicker("round-robin")
+	var seq strings.Builder
+	for i := 0; i < 14; i++ {
+		seq.WriteString(p.Pick(backends).Addr)
+	}
+	// Smooth weighted round-robin spreads the light backends out instead
+	// of sending the heavy one five requests in a row.
+	if got, want := seq.String(), "aabacaaaabacaa"; got != want {
+		t.Errorf("got sequence %s, want %s", got, want)
+	}
+}
+
+func TestRoundRobinDistribution(t *testing.T) {
+	backends := testBackends(5, 3, 2)
+	p, _ := newPicker("round-robin")
+	const n = 10000
+	// Round-robin is exact over every cycle of total weight picks.
+	checkShares(t, backends, pickIdle(p, backends, n), n, 0)
+}
+
+func TestRoundRobinForgetsRemovedBackends(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	p := &roundRobinPicker{current: make(map[*Backend]float64)}
+	pickIdle(p, backends, 10)
+	pickIdle(p, backends[:2], 10)
+	if _, ok := p.current[backends[2]]; ok || len(p.current) != 2 {
+		t.Errorf("picker still tracks %d backends, want 2", len(p.current))
+	}
+}
+
+func TestLeastRequestsDistribution(t *testing.T) {
+	backends := testBackends(5, 3, 2)
+	const n = 100000
+	checkShares(t, backends, pickUnderLoad(leastRequestsPicker{}, backends, n, 50), n, 0.02)
+}
+
+func TestLeastRequestsPrefersIdleBackend(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	backends[0].inflight, backends[2].inflight = 3, 1
+	if b := (leastRequestsPicker{}).Pick(backends); b != backends[1] {
+		t.Errorf("picked %s, want the idle backend b", b.Addr)
+	}
+}
+
+func TestP2CDistribution(t *testing.T) {
+	backends := testBackends(5, 3, 2)
+	const n = 100000
+	checkShares(t, backends, pickUnderLoad(p2cPicker{}, backends, n, 50), n, 0.03)
+}
+
+func TestPickersFollowSlowStart(t *testing.T) {
+	backends := testBackends(1, 1)
+	ss := &SlowStart{Window: 1 << 62, Curve: "linear", MinWeight: 0.25}
+	backends[1].slowStart = ss
+	backends[1].startWarming()
+	const n = 100000
+	picks := pickIdle(weightedRandomPicker{}, backends, n)
+	// b starts at a quarter of its weight: 0.25 / 1.25 of the picks.
+	if got := float64(picks[backends[1]]) / n; math.Abs(got-0.2) > 0.01 {
+		t.Errorf("warming backend got %.3f of picks, want 0.200", got)
+	}
+}
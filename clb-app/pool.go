@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool is the live set of backends requests are balanced over. Discovery
+// replaces its contents while requests are being served.
+type Pool struct {
+	name         string
+	static       bool              // backends come from the config file and are reloaded with it
+	outlier      *OutlierDetection // nil disables passive ejection
+	drainTimeout time.Duration     // longest wait for a dropped backend's requests
+	slowStart    *SlowStart        // nil gives new and recovered backends their full weight at once
+	affinity     *Affinity         // nil balances every request independently
+
+	ejectMu sync.Mutex
+
+	synced int32 // set once discovery first filled the pool, accessed atomically
+
+	mu       sync.RWMutex
+	strategy string
+	picker   Picker
+	hashKey  *HashKey // for hashPickers
+	backends []*Backend
+}
+
+func newPool(name, strategy string) (*Pool, error) {
+	p := &Pool{name: name}
+	if err := p.SetStrategy(strategy); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// startPool creates the pool described by pc and starts its discovery,
+// health checks and outlier sweeps, which run until ctx is done.
+func startPool(ctx context.Context, pc *PoolConfig) (*Pool, error) {
+	p, err := newPool(pc.Name, pc.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	p.static = pc.Discovery.isStatic()
+	p.hashKey = pc.HashKey
+	p.outlier = pc.OutlierDetection
+	p.drainTimeout = pc.DrainTimeout
+	p.slowStart = pc.SlowStart
+	if p.affinity = pc.Affinity; p.affinity != nil {
+		if err := p.affinity.loadKey(p.name); err != nil {
+			return nil, fmt.Errorf("affinity secret: %v", err)
+		}
+	}
+	if err := startDiscovery(ctx, p, pc); err != nil {
+		return nil, err
+	}
+	if p.outlier != nil {
+		go p.runOutlierSweeps(ctx)
+	}
+	if pc.HealthCheck != nil {
+		go runHealthChecks(ctx, p, pc.HealthCheck)
+	}
+	go p.runDrainSweeps(ctx)
+	return p, nil
+}
+
+// SetStrategy switches the pool to the named picker. Keeping the current
+// strategy leaves the picker and its state alone.
+func (p *Pool) SetStrategy(strategy string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.picker != nil && strategy == p.strategy {
+		return nil
+	}
+	picker, err := newPicker(strategy)
+	if err != nil {
+		return err
+	}
+	if p.picker != nil {
+		log.Printf("pool %s: balancing strategy changed from %q to %q", p.name, p.strategy, strategy)
+	}
+	p.strategy, p.picker = strategy, picker
+	return nil
+}
+
+// Pick selects a healthy, non-ejected backend for r, skipping any in exclude,
+// or returns nil if there is none. A backend r is pinned to by session
+// affinity is preferred; otherwise weights are only compared among the
+// selectable backends.
+func (p *Pool) Pick(r *http.Request, exclude ...*Backend) *Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now()
+	candidates := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.Healthy() && !b.Ejected(now) && atomic.LoadInt32(&b.state) == backendActive &&
+			b.Weight > 0 && !containsBackend(exclude, b) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	var b *Backend
+	if p.affinity != nil {
+		b = p.affinity.choose(r, p.name, candidates)
+	}
+	if hp, ok := p.picker.(hashPicker); ok && b == nil {
+		if key, ok := p.hashKey.value(r); ok {
+			b = hp.PickHash(candidates, hash64(key))
+		}
+	}
+	if b == nil {
+		b = p.picker.Pick(candidates)
+	}
+	selectionsTotal.inc(p.name, b.Addr)
+	return b
+}
+
+// Backends returns a snapshot of the current backend set.
+func (p *Pool) Backends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Backend(nil), p.backends...)
+}
+
+// SetHashKey changes the request key hashed by the ring-hash and maglev
+// strategies.
+func (p *Pool) SetHashKey(k *HashKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hashKey = k
+}
+
+// Strategy returns the name of the pool's balancing strategy.
+func (p *Pool) Strategy() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.strategy
+}
+
+// Update replaces the backend set with next. Backends whose address is
+// already in the pool keep their state and only take the new weight, unless
+// it was pinned through the admin API, so in-flight accounting survives an
+// update. Backends added through the admin API stay until removed there.
+//
+// Backends that are no longer in next, or that arrive in the draining state
+// because their endpoint is terminating, stop receiving new requests and
+// leave the pool once their in-flight requests finish or the drain timeout
+// passes. New backends slow-start, except for the pool's first set.
+func (p *Pool) Update(next []*Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	initial := len(p.backends) == 0
+	existing := make(map[string]*Backend, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.Addr] = b
+	}
+	merged := make([]*Backend, 0, len(next))
+	for _, b := range next {
+		old, ok := existing[b.Addr]
+		if !ok {
+			if b.Draining() {
+				continue
+			}
+			b.slowStart = p.slowStart
+			if !initial {
+				b.startWarming()
+			}
+			log.Printf("pool %s: backend %s added (weight %v)", p.name, b.Addr, b.Weight)
+			merged = append(merged, b)
+			continue
+		}
+		delete(existing, b.Addr)
+		if !old.weightPinned {
+			old.Weight = b.Weight
+		}
+		old.Zone, old.Metadata = b.Zone, b.Metadata
+		switch {
+		case b.Draining():
+			p.drain(old, "endpoint terminating")
+		case old.Draining() && old.drainRemove:
+			// The address is back, e.g. a new pod reusing it.
+			atomic.StoreInt32(&old.state, backendActive)
+			old.drainRemove = false
+			log.Printf("pool %s: backend %s is back, drain cancelled", p.name, old.Addr)
+		}
+		merged = append(merged, old)
+	}
+	for addr, b := range existing {
+		switch {
+		case b.manual:
+		case atomic.LoadInt64(&b.inflight) == 0:
+			log.Printf("pool %s: backend %s removed", p.name, addr)
+			continue
+		default:
+			p.drain(b, "no longer discovered")
+		}
+		merged = append(merged, b)
+	}
+	p.backends = merged
+	atomic.StoreInt32(&p.synced, 1)
+}
+
+// Synced reports whether discovery has delivered the pool's backends at
+// least once.
+func (p *Pool) Synced() bool {
+	return atomic.LoadInt32(&p.synced) == 1
+}
+
+// drain stops new requests to b and has it removed once drained. p.mu must be
+// held.
+func (p *Pool) drain(b *Backend, reason string) {
+	if b.Draining() && b.drainRemove {
+		return
+	}
+	if !b.Draining() {
+		atomic.StoreInt64(&b.drainStarted, time.Now().UnixNano())
+		atomic.StoreInt32(&b.state, backendDraining)
+	}
+	b.drainRemove = true
+	log.Printf("pool %s: draining backend %s (%s), %d requests in flight",
+		p.name, b.Addr, reason, atomic.LoadInt64(&b.inflight))
+}
+
+// SetState changes b's administrative state to the named one. A backend
+// drained this way stays in the pool, without new requests, until it is
+// activated or removed. Reactivating a backend slow-starts it.
+func (p *Pool) SetState(b *Backend, name string) error {
+	state, err := parseBackendState(name)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch old := atomic.LoadInt32(&b.state); {
+	case state == backendDraining && old != backendDraining:
+		atomic.StoreInt64(&b.drainStarted, time.Now().UnixNano())
+	case state == backendActive && old != backendActive:
+		b.startWarming()
+	}
+	b.drainRemove = false
+	atomic.StoreInt32(&b.state, state)
+	return nil
+}
+
+// runDrainSweeps removes drained backends every second until ctx is done.
+func (p *Pool) runDrainSweeps(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.sweepDrains(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pool) sweepDrains(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var kept []*Backend
+	for _, b := range p.backends {
+		if !b.Draining() || !b.drainRemove {
+			kept = append(kept, b)
+			continue
+		}
+		elapsed := b.drainingFor(now).Round(time.Millisecond)
+		switch inflight := atomic.LoadInt64(&b.inflight); {
+		case inflight == 0:
+			log.Printf("pool %s: backend %s drained in %v and removed", p.name, b.Addr, elapsed)
+			drainsTotal.inc(p.name, "completed")
+		case elapsed >= p.drainTimeout:
+			log.Printf("pool %s: backend %s removed after drain timeout %v with %d requests in flight", p.name, b.Addr, p.drainTimeout, inflight)
+			drainsTotal.inc(p.name, "timeout")
+		default:
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) != len(p.backends) {
+		p.backends = kept
+	}
+}
+
+// Lookup returns the backend with address addr, or nil.
+func (p *Pool) Lookup(addr string) *Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, b := range p.backends {
+		if b.Addr == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+// Add adds b to the pool as a manual backend, which discovery leaves alone.
+func (p *Pool) Add(b *Backend) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, other := range p.backends {
+		if other.Addr == b.Addr {
+			return fmt.Errorf("backend %s is already in pool %s", b.Addr, p.name)
+		}
+	}
+	b.manual, b.weightPinned = true, true
+	b.slowStart = p.slowStart
+	b.startWarming()
+	p.backends = append(p.backends, b)
+	log.Printf("pool %s: backend %s added (weight %v)", p.name, b.Addr, b.Weight)
+	return nil
+}
+
+// Remove takes the backend with address addr out of the pool. Requests in
+// flight to it finish normally. A discovered backend comes back when
+// discovery next reports it.
+func (p *Pool) Remove(addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, b := range p.backends {
+		if b.Addr == addr {
+			p.backends = append(p.backends[:i:i], p.backends[i+1:]...)
+			log.Printf("pool %s: backend %s removed", p.name, addr)
+			return true
+		}
+	}
+	return false
+}
+
+// Weight returns b's current weight.
+func (p *Pool) Weight(b *Backend) float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return b.Weight
+}
+
+// EffectiveWeight returns the weight b is currently balanced with, see
+// Backend.effectiveWeight.
+func (p *Pool) EffectiveWeight(b *Backend) float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return b.effectiveWeight()
+}
+
+// SetWeight changes b's weight and pins it against discovery and reloads.
+func (p *Pool) SetWeight(b *Backend, weight float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.Weight, b.weightPinned = weight, true
+}
+
+func containsBackend(list []*Backend, b *Backend) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
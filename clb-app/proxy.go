@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hopHeaders are removed from both directions of a proxied exchange, see
+// RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func setForwardedHeaders(out, in *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		if prior := in.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+}
+
+// newUpstreamRequest builds the request sent to target, keeping the client's
+// method, URI, Host, headers and body. Backends that serve several virtual
+// hosts need the original Host; the connection itself goes to target.
+func newUpstreamRequest(r *http.Request, target string) *http.Request {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = "http"
+	out.URL.Host = target
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+	out.Close = false
+
+	removeHopHeaders(out.Header)
+	setForwardedHeaders(out, r)
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// Keep net/http from adding its own User-Agent.
+		out.Header.Set("User-Agent", "")
+	}
+	return out
+}
+
+// copyResponse writes the upstream status, headers, body and trailers to w,
+// flushing the body as it arrives according to flushInterval.
+func copyResponse(w http.ResponseWriter, resp *http.Response, flushInterval time.Duration) error {
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+
+	announced := len(resp.Trailer)
+	if announced > 0 {
+		keys := make([]string, 0, announced)
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	dst := newFlushWriter(w, flushInterval)
+	if fw, ok := dst.(*flushWriter); ok {
+		defer fw.stop()
+		if flushInterval < 0 {
+			// Send the headers right away; an event stream may stay quiet.
+			fw.flusher.Flush()
+		}
+	}
+	buf := make([]byte, 32*1024)
+	if _, err := io.CopyBuffer(dst, resp.Body, buf); err != nil {
+		return err
+	}
+
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+	return nil
+}
+
+// statusWriter remembers the status code and body size sent to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int // 0 until the header is written
+	written int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
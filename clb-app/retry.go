@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides whether a failed upstream attempt is tried again on
+// another backend.
+type RetryPolicy struct {
+	MaxAttempts        int           `json:"max_attempts"`         // total attempts including the first
+	Conditions         []string      `json:"on"`                   // see retryConditions
+	PerTryTimeout      time.Duration `json:"per_try_timeout"`      // time to response headers per attempt, 0 for none
+	Budget             time.Duration `json:"budget"`               // time to response headers over all attempts, 0 for none
+	RetryNonIdempotent bool          `json:"retry_non_idempotent"` // also retry other methods when the body is buffered
+	BufferLimit        int64         `json:"buffer_limit"`         // largest request body buffered for replay
+
+	on map[string]bool // Conditions as a set, filled by validate
+}
+
+var retryConditions = []string{"connect-failure", "reset", "timeout", "502", "503", "504"}
+
+var errPerTryTimeout = errors.New("upstream attempt timed out")
+
+// applyEnv applies the RETRY_* overrides.
+func (rp *RetryPolicy) applyEnv() error {
+	var err error
+	if rp.MaxAttempts, err = envInt("RETRY_MAX_ATTEMPTS", rp.MaxAttempts); err != nil {
+		return err
+	}
+	if v := os.Getenv("RETRY_ON"); v != "" {
+		rp.Conditions = nil
+		for _, c := range strings.Split(v, ",") {
+			rp.Conditions = append(rp.Conditions, strings.TrimSpace(c))
+		}
+	}
+	if rp.PerTryTimeout, err = envTimeout("RETRY_PER_TRY_TIMEOUT", rp.PerTryTimeout); err != nil {
+		return err
+	}
+	if rp.Budget, err = envTimeout("RETRY_BUDGET", rp.Budget); err != nil {
+		return err
+	}
+	switch os.Getenv("RETRY_NON_IDEMPOTENT") {
+	case "on":
+		rp.RetryNonIdempotent = true
+	case "off":
+		rp.RetryNonIdempotent = false
+	}
+	if rp.BufferLimit, err = envSize("RETRY_BUFFER_LIMIT", rp.BufferLimit); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rp *RetryPolicy) validate(v *validator, path string) {
+	if rp.MaxAttempts < 1 {
+		v.errorf(path+".max_attempts", "must be at least 1")
+	}
+	rp.on = make(map[string]bool)
+	for i, c := range rp.Conditions {
+		if !containsString(retryConditions, c) {
+			v.errorf(fmt.Sprintf("%s.on[%d]", path, i), "unknown condition %q, want one of %s", c, strings.Join(retryConditions, ", "))
+		}
+		rp.on[c] = true
+	}
+	if rp.PerTryTimeout < 0 {
+		v.errorf(path+".per_try_timeout", "must not be negative")
+	}
+	if rp.Budget < 0 {
+		v.errorf(path+".budget", "must not be negative")
+	}
+	if rp.BufferLimit < 0 {
+		v.errorf(path+".buffer_limit", "must not be negative")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// prepareBody decides whether r may be retried and, if so, buffers its body
+// so every attempt can send it again. A body larger than the buffer limit is
+// passed through untouched and the request gets a single attempt.
+func (rp *RetryPolicy) prepareBody(r *http.Request) (retryable bool, err error) {
+	if rp.MaxAttempts < 2 || (!isIdempotent(r.Method) && !rp.RetryNonIdempotent) {
+		return false, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return true, nil
+	}
+	if r.ContentLength > rp.BufferLimit {
+		return false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, rp.BufferLimit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > rp.BufferLimit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return false, nil
+	}
+	r.Body.Close()
+	r.ContentLength = int64(len(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
+
+// shouldRetry reports whether the outcome of an attempt matches one of the
+// policy's retry conditions.
+func (rp *RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err == nil {
+		return rp.on[fmt.Sprint(resp.StatusCode)]
+	}
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, errPerTryTimeout):
+		return rp.on["timeout"]
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return rp.on["connect-failure"]
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return rp.on["reset"]
+	}
+	return false
+}
+
+// sendAttempt sends one try of r to b. If no response headers arrive within
+// timeout the attempt is cancelled and errPerTryTimeout returned. done must be
+// called once the response body has been consumed.
+func sendAttempt(r *http.Request, b *Backend, timeout time.Duration) (resp *http.Response, done func(), err error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	release := b.acquire()
+	done = func() {
+		cancel()
+		release()
+	}
+
+	var timedOut int32
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+	}
+	out := newUpstreamRequest(r.WithContext(ctx), b.Addr)
+	if r.GetBody != nil && out.Body != nil {
+		out.Body, _ = r.GetBody()
+	}
+	resp, err = upstreamTransport.RoundTrip(out)
+	if timer != nil && !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		if err == nil {
+			resp.Body.Close()
+		}
+		resp, err = nil, fmt.Errorf("%w after %v", errPerTryTimeout, timeout)
+	}
+	if err != nil {
+		done()
+		return nil, func() {}, err
+	}
+	return resp, done, nil
+}
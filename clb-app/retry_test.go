@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// retryBackend is a test backend that answers every request the same way
+// and records the bodies it received.
+type retryBackend struct {
+	addr string
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+// startRetryBackend starts a backend behaving as kind: "ok" and "503" answer
+// with that status, "slow" answers after a second, and "down" refuses
+// connections.
+func startRetryBackend(t *testing.T, kind string) *retryBackend {
+	t.Helper()
+	b := &retryBackend{}
+	if kind == "down" {
+		b.addr = freeAddr(t)
+		return b
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		b.mu.Lock()
+		b.bodies = append(b.bodies, string(body))
+		b.mu.Unlock()
+		switch kind {
+		case "503":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "slow":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	b.addr = strings.TrimPrefix(s.URL, "http://")
+	return b
+}
+
+func (b *retryBackend) received() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.bodies...)
+}
+
+func TestRetries(t *testing.T) {
+	const body = "0123456789"
+	tests := []struct {
+		name     string
+		backends []string
+		retries  string
+		method   string
+		body     io.Reader
+		status   int
+		attempts int // requests the backends received in all
+	}{
+		{
+			name:     "503 moves to another backend",
+			backends: []string{"503", "503", "ok"},
+			retries:  "max_attempts: 3\n  on: [503]",
+			status:   http.StatusOK,
+			attempts: 3,
+		},
+		{
+			name:     "connect failure moves to another backend",
+			backends: []string{"down", "down", "ok"},
+			retries:  "max_attempts: 3\n  on: [connect-failure]",
+			status:   http.StatusOK,
+			attempts: 1, // refused connections are not counted
+		},
+		{
+			name:     "attempts run out",
+			backends: []string{"503", "503", "503"},
+			retries:  "max_attempts: 2\n  on: [503]",
+			status:   http.StatusServiceUnavailable,
+			attempts: 2,
+		},
+		{
+			name:     "tried backends run out",
+			backends: []string{"503", "503"},
+			retries:  "max_attempts: 5\n  on: [503]",
+			status:   http.StatusServiceUnavailable,
+			attempts: 2,
+		},
+		{
+			name:     "status not retried",
+			backends: []string{"503", "503"},
+			retries:  "max_attempts: 3\n  on: [502]",
+			status:   http.StatusServiceUnavailable,
+			attempts: 1,
+		},
+		{
+			name:     "POST not retried by default",
+			backends: []string{"503", "503"},
+			retries:  "max_attempts: 3\n  on: [503]",
+			method:   "POST",
+			body:     strings.NewReader(body),
+			status:   http.StatusServiceUnavailable,
+			attempts: 1,
+		},
+		{
+			name:     "POST retried with its body replayed",
+			backends: []string{"503", "503", "ok"},
+			retries:  "max_attempts: 3\n  on: [503]\n  retry_non_idempotent: true",
+			method:   "POST",
+			body:     strings.NewReader(body),
+			status:   http.StatusOK,
+			attempts: 3,
+		},
+		{
+			name:     "body over the buffer limit",
+			backends: []string{"503", "503"},
+			retries:  "max_attempts: 3\n  on: [503]\n  retry_non_idempotent: true\n  buffer_limit: 4",
+			method:   "POST",
+			body:     strings.NewReader(body),
+			status:   http.StatusServiceUnavailable,
+			attempts: 1,
+		},
+		{
+			name:     "body of unknown length over the buffer limit",
+			backends: []string{"503", "503"},
+			retries:  "max_attempts: 3\n  on: [503]\n  buffer_limit: 4",
+			method:   "PUT",
+			body:     io.MultiReader(strings.NewReader(body)),
+			status:   http.StatusServiceUnavailable,
+			attempts: 1,
+		},
+		{
+			name:     "per-try timeout moves to another backend",
+			backends: []string{"slow", "slow", "ok"},
+			retries:  "max_attempts: 3\n  on: [timeout]\n  per_try_timeout: 100ms",
+			status:   http.StatusOK,
+			attempts: 3,
+		},
+		{
+			name:     "budget ends the attempts",
+			backends: []string{"slow", "slow", "slow", "slow"},
+			retries:  "max_attempts: 4\n  on: [timeout]\n  per_try_timeout: 100ms\n  budget: 150ms",
+			status:   http.StatusGatewayTimeout,
+			attempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backends []*retryBackend
+			var cfg strings.Builder
+			// Round-robin tries the backends in order, failing ones first.
+			cfg.WriteString("pools:\n  - name: web\n    strategy: round-robin\n    backends:\n")
+			for _, kind := range tt.backends {
+				b := startRetryBackend(t, kind)
+				backends = append(backends, b)
+				fmt.Fprintf(&cfg, "      - address: %s\n", b.addr)
+			}
+			fmt.Fprintf(&cfg, "retries:\n  %s\naccess_log:\n  output: \"off\"\n", tt.retries)
+			setupTestProxy(t, cfg.String())
+
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			loadBalance(w, httptest.NewRequest(method, "/", tt.body))
+			if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+				t.Errorf("took %v, want the slow backends cut off", elapsed)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+
+			attempts := 0
+			for i, b := range backends {
+				got := b.received()
+				attempts += len(got)
+				if len(got) > 1 {
+					t.Errorf("backend %d (%s) got %d attempts, want tried backends excluded", i, tt.backends[i], len(got))
+				}
+				for _, gotBody := range got {
+					if tt.body != nil && gotBody != body {
+						t.Errorf("backend %d got body %q, want %q", i, gotBody, body)
+					}
+				}
+			}
+			if attempts != tt.attempts {
+				t.Errorf("backends got %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	rp := &RetryPolicy{MaxAttempts: 2, Conditions: []string{"reset", "503"}}
+	rp.validate(&validator{}, "retries")
+	for _, tt := range []struct {
+		status int
+		err    error
+		want   bool
+	}{
+		{status: 503, want: true},
+		{status: 502, want: false},
+		{status: 200, want: false},
+		{err: io.ErrUnexpectedEOF, want: true},
+		{err: fmt.Errorf("%w after 1s", errPerTryTimeout), want: false},
+	} {
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := rp.shouldRetry(resp, tt.err); got != tt.want {
+			t.Errorf("shouldRetry(%d, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
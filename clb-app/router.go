@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// currentRouter holds the active *Router. It is replaced as a whole on config
+// reload so requests never see a half-applied route table.
+var currentRouter atomic.Value
+
+// Router picks the pool for a request from the configured routes, first match
+// wins.
+type Router struct {
+	routes   []route
+	splits   map[string]*Split
+	fallback *Pool // for requests no route matches; nil answers 404
+}
+
+type route struct {
+	host       string // lower case, "*.example.com" matches any subdomain
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	methods    []string
+	headers    []HeaderMatch
+	pool       *Pool
+	split      *Split // instead of pool
+	mirror     *mirror
+}
+
+// newRouter builds a router over validated routes, whose pool and split
+// names must all be in pools and splits.
+func newRouter(routes []*RouteConfig, pools map[string]*Pool, splits map[string]*Split, fallback *Pool) *Router {
+	rt := &Router{splits: splits, fallback: fallback}
+	for _, rc := range routes {
+		rr := route{
+			host:       strings.ToLower(rc.Host),
+			pathPrefix: rc.PathPrefix,
+			pathRegex:  rc.pathRegex,
+			headers:    rc.Headers,
+			pool:       pools[rc.Pool],
+			split:      splits[rc.Split],
+			mirror:     newMirror(rc.Mirror, pools),
+		}
+		for _, m := range rc.Methods {
+			rr.methods = append(rr.methods, strings.ToUpper(m))
+		}
+		rt.routes = append(rt.routes, rr)
+	}
+	return rt
+}
+
+// Match returns the pool for r, or nil if no route matches and there is no
+// fallback, and the route's mirror if it has one.
+func (rt *Router) Match(r *http.Request) (*Pool, *mirror) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, rr := range rt.routes {
+		if !rr.match(r, host) {
+			continue
+		}
+		if rr.split != nil {
+			return rr.split.choose(r), rr.mirror
+		}
+		return rr.pool, rr.mirror
+	}
+	return rt.fallback, nil
+}
+
+func (rr *route) match(r *http.Request, host string) bool {
+	if !rr.matchHost(host) || !strings.HasPrefix(r.URL.Path, rr.pathPrefix) {
+		return false
+	}
+	if rr.pathRegex != nil && !rr.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rr.methods) > 0 && !containsString(rr.methods, r.Method) {
+		return false
+	}
+	for _, hm := range rr.headers {
+		if !hm.match(r.Header) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rr *route) matchHost(host string) bool {
+	switch {
+	case rr.host == "":
+		return true
+	case strings.HasPrefix(rr.host, "*."):
+		return strings.HasSuffix(host, rr.host[1:])
+	default:
+		return host == rr.host
+	}
+}
+
+func (hm *HeaderMatch) match(h http.Header) bool {
+	values, ok := h[http.CanonicalHeaderKey(hm.Name)]
+	if !ok {
+		return false
+	}
+	if hm.Value == "" && hm.regex == nil {
+		return true
+	}
+	for _, v := range values {
+		if (hm.regex != nil && hm.regex.MatchString(v)) || (hm.regex == nil && v == hm.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *RouteConfig) validate(v *validator, path string) {
+	if rc.PathPrefix != "" && !strings.HasPrefix(rc.PathPrefix, "/") {
+		v.errorf(path+".path_prefix", "must start with /, got %q", rc.PathPrefix)
+	}
+	if rc.PathRegex != "" {
+		var err error
+		if rc.pathRegex, err = compileFullMatch(rc.PathRegex); err != nil {
+			v.errorf(path+".path_regex", "%v", err)
+		}
+	}
+	for i, m := range rc.Methods {
+		if m == "" || strings.ContainsAny(m, " \t/") {
+			v.errorf(fmt.Sprintf("%s.methods[%d]", path, i), "invalid method %q", m)
+		}
+	}
+	for i := range rc.Headers {
+		hm := &rc.Headers[i]
+		hpath := fmt.Sprintf("%s.headers[%d]", path, i)
+		if hm.Name == "" {
+			v.errorf(hpath+".name", "is required")
+		}
+		if hm.Value != "" && hm.Regex != "" {
+			v.errorf(hpath, "set value or regex, not both")
+		}
+		if hm.Regex != "" {
+			var err error
+			if hm.regex, err = compileFullMatch(hm.Regex); err != nil {
+				v.errorf(hpath+".regex", "%v", err)
+			}
+		}
+	}
+}
+
+// compileFullMatch compiles expr so that it has to match a whole string.
+func compileFullMatch(expr string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(expr); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
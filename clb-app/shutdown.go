@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// draining is set once shutdown has begun, accessed atomically.
+var draining int32
+
+// Shutdown controls how the balancer leaves service on SIGTERM.
+type Shutdown struct {
+	// ReadinessDelay is how long /readyz fails before the listener closes,
+	// giving Kubernetes time to take the pod out of the Service.
+	ReadinessDelay time.Duration `json:"readiness_delay"`
+	// DrainTimeout bounds the wait for in-flight proxied requests.
+	DrainTimeout time.Duration `json:"drain_timeout"`
+}
+
+// applyEnv applies the SHUTDOWN_READINESS_DELAY and SHUTDOWN_DRAIN_TIMEOUT
+// overrides.
+func (s *Shutdown) applyEnv() error {
+	var err error
+	if s.ReadinessDelay, err = envTimeout("SHUTDOWN_READINESS_DELAY", s.ReadinessDelay); err != nil {
+		return err
+	}
+	if s.DrainTimeout, err = envDuration("SHUTDOWN_DRAIN_TIMEOUT", s.DrainTimeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Shutdown) validate(v *validator, path string) {
+	if s.ReadinessDelay < 0 {
+		v.errorf(path+".readiness_delay", "must not be negative")
+	}
+	if s.DrainTimeout <= 0 {
+		v.errorf(path+".drain_timeout", "must be positive")
+	}
+}
+
+func livez(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz fails until discovery has filled every pool, so that a new pod
+// gets no traffic it could only answer with 503s, and again as soon as the
+// balancer starts shutting down.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&draining) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	for name, p := range pools {
+		if !p.Synced() {
+			http.Error(w, fmt.Sprintf("waiting for discovery of pool %s", name), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveUntilSignal runs the proxy servers and admin until SIGTERM or SIGINT,
+// then shuts them down as serveUntil describes.
+func (s *Shutdown) serveUntilSignal(servers []*http.Server, admin *http.Server) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigc)
+	s.serveUntil(servers, admin, sigc)
+}
+
+// serveUntil runs the proxy servers and admin until a signal arrives on stop,
+// then fails readiness, waits ReadinessDelay, stops accepting connections and
+// waits for in-flight requests before closing idle upstream connections.
+func (s *Shutdown) serveUntil(servers []*http.Server, admin *http.Server, stop <-chan os.Signal) {
+	all := append([]*http.Server{admin}, servers...)
+	errc := make(chan error, len(all))
+	for _, hs := range all {
+		go func(hs *http.Server) {
+			if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+				errc <- fmt.Errorf("serving %s: %v", hs.Addr, err)
+			}
+		}(hs)
+	}
+
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("received %v, failing readiness for %v before draining", sig, s.ReadinessDelay)
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	time.Sleep(s.ReadinessDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+	start := time.Now()
+	errc = make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) { errc <- srv.Shutdown(ctx) }(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errc; e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf("drain did not finish within %v: %v", s.DrainTimeout, err)
+	} else {
+		log.Printf("drained in-flight requests in %v", time.Since(start).Round(time.Millisecond))
+	}
+	upstreamTransport.CloseIdleConnections()
+	admin.Shutdown(ctx)
+}
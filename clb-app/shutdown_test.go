@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestShutdownDropsNoRequests starts the servers, keeps slow requests in
+// flight and shuts down: readiness must fail first, every in-flight request
+// must complete, and the listener must refuse connections once the readiness
+// delay is over.
+func TestShutdownDropsNoRequests(t *testing.T) {
+	const (
+		inFlight       = 5
+		readinessDelay = 300 * time.Millisecond
+		requestTime    = 1500 * time.Millisecond
+	)
+	var started int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&started, 1)
+		time.Sleep(requestTime)
+		fmt.Fprint(w, "done")
+	}))
+	defer backend.Close()
+
+	cfg := setupTestProxy(t, fmt.Sprintf(`
+pools:
+  - name: web
+    backends:
+      - address: %s
+shutdown:
+  readiness_delay: %v
+  drain_timeout: 10s
+access_log:
+  output: "off"
+`, strings.TrimPrefix(backend.URL, "http://"), readinessDelay))
+	defer atomic.StoreInt32(&draining, 0)
+
+	proxyAddr, adminAddr := freeAddr(t), freeAddr(t)
+	admin := http.NewServeMux()
+	admin.HandleFunc("/readyz", readyz)
+	servers := []*http.Server{timeouts.newServer(proxyAddr, http.HandlerFunc(loadBalance))}
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		cfg.Shutdown.serveUntil(servers, timeouts.newServer(adminAddr, admin), stop)
+		close(stopped)
+	}()
+
+	readiness := func() int {
+		resp, err := http.Get("http://" + adminAddr + "/readyz")
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitFor(t, "the servers to start", func() bool { return readiness() == http.StatusOK })
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	results := make(chan result, inFlight)
+	for i := 0; i < inFlight; i++ {
+		go func() {
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			resp, err := client.Get("http://" + proxyAddr + "/")
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			results <- result{resp.StatusCode, string(body), err}
+		}()
+	}
+	waitFor(t, "the requests to reach the backend", func() bool { return atomic.LoadInt32(&started) == inFlight })
+
+	signalled := time.Now()
+	stop <- syscall.SIGTERM
+	waitFor(t, "readiness to fail", func() bool { return readiness() == http.StatusServiceUnavailable })
+	if time.Since(signalled) >= readinessDelay {
+		t.Errorf("readiness failed only after %v, want within the %v readiness delay", time.Since(signalled), readinessDelay)
+	}
+	if len(results) > 0 {
+		t.Errorf("%d requests finished before readiness failed", len(results))
+	}
+
+	// Once the delay is over the listener closes while the requests drain.
+	time.Sleep(readinessDelay + 200*time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", proxyAddr, time.Second); err == nil {
+		conn.Close()
+		t.Error("proxy still accepts connections after the readiness delay")
+	}
+
+	for i := 0; i < inFlight; i++ {
+		r := <-results
+		if r.err != nil || r.status != http.StatusOK || r.body != "done" {
+			t.Errorf("in-flight request: status %d, body %q, error %v; want 200 done", r.status, r.body, r.err)
+		}
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish after the requests drained")
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadyzWaitsForDiscovery(t *testing.T) {
+	defer func(prev map[string]*Pool) { pools = prev }(pools)
+	static, _ := newPool("static", "round-robin")
+	static.Update(testBackends(1))
+	discovered, _ := newPool("discovered", "round-robin")
+	pools = map[string]*Pool{"static": static, "discovered": discovered}
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("before discovery: readiness %d, want 503", got)
+	}
+	// An empty first result still counts as synced.
+	discovered.Update(nil)
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("after discovery: readiness %d, want 200", got)
+	}
+}
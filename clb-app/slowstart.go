@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// SlowStart ramps up the share of requests a backend receives after it joins
+// a pool or recovers from a failed health check, an outlier ejection or being
+// disabled, so that a cold pod is not hit with its full weight at once. The
+// effective weight starts at MinWeight times the configured weight and grows
+// to the full weight over Window.
+type SlowStart struct {
+	Window    time.Duration `json:"window"`
+	Curve     string        `json:"curve"`      // "linear" or "exponential"
+	MinWeight float64       `json:"min_weight"` // starting fraction of the configured weight
+}
+
+func (ss *SlowStart) setDefaults() {
+	ss.Window = 30 * time.Second
+	ss.Curve = "linear"
+	ss.MinWeight = 0.1
+}
+
+// applyEnv applies the SLOW_START_* overrides.
+func (ss *SlowStart) applyEnv() error {
+	ss.Curve = envOr("SLOW_START_CURVE", ss.Curve)
+	var err error
+	if ss.Window, err = envDuration("SLOW_START_WINDOW", ss.Window); err != nil {
+		return err
+	}
+	if ss.MinWeight, err = envFloat("SLOW_START_MIN_WEIGHT", ss.MinWeight); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ss *SlowStart) validate(v *validator, path string) {
+	if ss.Window <= 0 {
+		v.errorf(path+".window", "must be positive")
+	}
+	if ss.Curve != "linear" && ss.Curve != "exponential" {
+		v.errorf(path+".curve", "must be linear or exponential, got %q", ss.Curve)
+	}
+	if !(ss.MinWeight > 0 && ss.MinWeight <= 1) {
+		v.errorf(path+".min_weight", "must be greater than 0 and at most 1, got %v", ss.MinWeight)
+	}
+}
+
+// factor is the share of its weight a backend gets elapsed into its ramp.
+// The linear curve adds the same weight every second; the exponential one
+// multiplies it by the same factor, staying low for longer.
+func (ss *SlowStart) factor(elapsed time.Duration) float64 {
+	if elapsed >= ss.Window {
+		return 1
+	}
+	f := 0.0
+	if elapsed > 0 {
+		f = float64(elapsed) / float64(ss.Window)
+	}
+	if ss.Curve == "exponential" {
+		return math.Pow(ss.MinWeight, 1-f)
+	}
+	return ss.MinWeight + (1-ss.MinWeight)*f
+}
+
+// startWarming restarts b's slow-start ramp. It has no effect unless b's pool
+// has slow start configured.
+func (b *Backend) startWarming() {
+	atomic.StoreInt64(&b.warmingSince, time.Now().UnixNano())
+}
+
+// effectiveWeight is the weight pickers balance with: b's weight, scaled
+// down while it is slow-starting. The end of an outlier ejection starts a
+// ramp too.
+func (b *Backend) effectiveWeight() float64 {
+	if b.slowStart == nil {
+		return b.Weight
+	}
+	since := atomic.LoadInt64(&b.warmingSince)
+	if until := atomic.LoadInt64(&b.ejectedUntil); until > since {
+		since = until
+	}
+	if since == 0 {
+		return b.Weight
+	}
+	return b.Weight * b.slowStart.factor(time.Since(time.Unix(0, since)))
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// SplitConfig divides the traffic of the routes that name it between pools
+// by weight, e.g. 90 to the pool running v1 and 10 to the one running v2.
+// Pins send requests carrying a header or cookie value to one pool
+// regardless of the weights.
+type SplitConfig struct {
+	Name    string        `json:"name"`
+	Targets []SplitTarget `json:"targets"`
+	Pins    []SplitPin    `json:"pins"`
+}
+
+// SplitTarget is a pool's share of a split. Weights are relative; using
+// percentages keeps them readable.
+type SplitTarget struct {
+	Pool   string  `json:"pool"`
+	Weight float64 `json:"weight"`
+}
+
+// SplitPin matches requests whose header or cookie has Value.
+type SplitPin struct {
+	Header string `json:"header"`
+	Cookie string `json:"cookie"`
+	Value  string `json:"value"`
+	Pool   string `json:"pool"`
+}
+
+func (sc *SplitConfig) validate(v *validator, path string, pools map[string]bool) {
+	if len(sc.Targets) == 0 {
+		v.errorf(path+".targets", "at least one target is required")
+	}
+	seen := make(map[string]bool)
+	total := 0.0
+	for i, t := range sc.Targets {
+		tpath := fmt.Sprintf("%s.targets[%d]", path, i)
+		if !pools[t.Pool] {
+			v.errorf(tpath+".pool", "unknown pool %q", t.Pool)
+		} else if seen[t.Pool] {
+			v.errorf(tpath+".pool", "pool %q listed more than once", t.Pool)
+		}
+		seen[t.Pool] = true
+		if !validWeight(t.Weight) {
+			v.errorf(tpath+".weight", "must be a non-negative number, got %v", t.Weight)
+		} else {
+			total += t.Weight
+		}
+	}
+	if len(sc.Targets) > 0 && total == 0 {
+		v.errorf(path+".targets", "total weight is zero")
+	}
+	for i, p := range sc.Pins {
+		ppath := fmt.Sprintf("%s.pins[%d]", path, i)
+		if (p.Header == "") == (p.Cookie == "") {
+			v.errorf(ppath, "set exactly one of header and cookie")
+		}
+		if p.Value == "" {
+			v.errorf(ppath+".value", "is required")
+		}
+		if !seen[p.Pool] {
+			v.errorf(ppath+".pool", "must be one of the split's targets, got %q", p.Pool)
+		}
+	}
+}
+
+// Split is the running form of a SplitConfig. Its weights can be changed
+// through the admin API for progressive rollouts; such changes survive config
+// reloads until the configured targets themselves change.
+type Split struct {
+	name string
+
+	mu       sync.RWMutex
+	targets  []splitTarget
+	pins     []splitPin
+	adjusted bool // weights were set through the admin API
+}
+
+type splitTarget struct {
+	pool   *Pool
+	weight float64
+}
+
+type splitPin struct {
+	SplitPin
+	pool *Pool
+}
+
+// buildSplits creates the splits described by configs over pools. Splits in
+// prev with the same name are updated in place.
+func buildSplits(configs []*SplitConfig, pools map[string]*Pool, prev map[string]*Split) map[string]*Split {
+	splits := make(map[string]*Split, len(configs))
+	for _, sc := range configs {
+		s := prev[sc.Name]
+		if s == nil {
+			s = &Split{name: sc.Name}
+		}
+		s.configure(sc, pools)
+		splits[sc.Name] = s
+	}
+	return splits
+}
+
+func (s *Split) configure(sc *SplitConfig, pools map[string]*Pool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := make([]splitTarget, 0, len(sc.Targets))
+	for _, t := range sc.Targets {
+		targets = append(targets, splitTarget{pools[t.Pool], t.Weight})
+	}
+	if s.adjusted && sameSplitPools(s.targets, targets) {
+		log.Printf("split %s: keeping weights set through the admin API", s.name)
+	} else {
+		s.targets, s.adjusted = targets, false
+	}
+	s.pins = s.pins[:0]
+	for _, p := range sc.Pins {
+		s.pins = append(s.pins, splitPin{p, pools[p.Pool]})
+	}
+}
+
+func sameSplitPools(a, b []splitTarget) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].pool != b[i].pool {
+			return false
+		}
+	}
+	return true
+}
+
+// choose returns the pool for r: a pinned pool if a pin matches, otherwise a
+// target picked by weight.
+func (s *Split) choose(r *http.Request) *Pool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.pins {
+		if p.match(r) {
+			splitRequestsTotal.inc(s.name, p.pool.name, "pin")
+			return p.pool
+		}
+	}
+	total := 0.0
+	for _, t := range s.targets {
+		total += t.weight
+	}
+	x := rand.Float64() * total
+	chosen := s.targets[len(s.targets)-1].pool
+	for _, t := range s.targets {
+		if t.weight > 0 && x < t.weight {
+			chosen = t.pool
+			break
+		}
+		x -= t.weight
+	}
+	splitRequestsTotal.inc(s.name, chosen.name, "weight")
+	return chosen
+}
+
+func (p *splitPin) match(r *http.Request) bool {
+	if p.Header != "" {
+		for _, v := range r.Header.Values(p.Header) {
+			if v == p.Value {
+				return true
+			}
+		}
+		return false
+	}
+	c, err := r.Cookie(p.Cookie)
+	return err == nil && c.Value == p.Value
+}
+
+// Weights returns each target pool's share of the split in percent.
+func (s *Split) Weights() map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	total := 0.0
+	for _, t := range s.targets {
+		total += t.weight
+	}
+	shares := make(map[string]float64, len(s.targets))
+	for _, t := range s.targets {
+		shares[t.pool.name] = t.weight / total * 100
+	}
+	return shares
+}
+
+// Adjusted reports whether the weights were set through the admin API.
+func (s *Split) Adjusted() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.adjusted
+}
+
+// SetWeights replaces the weights of the named targets; targets not in
+// weights keep theirs.
+func (s *Split) SetWeights(weights map[string]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := append([]splitTarget(nil), s.targets...)
+	for name, w := range weights {
+		i := s.target(name)
+		if i < 0 {
+			return fmt.Errorf("pool %q is not a target of split %s", name, s.name)
+		}
+		if !validWeight(w) {
+			return fmt.Errorf("weight must be a non-negative number, got %v", w)
+		}
+		next[i].weight = w
+	}
+	total := 0.0
+	for _, t := range next {
+		total += t.weight
+	}
+	if total == 0 {
+		return fmt.Errorf("total weight would be zero")
+	}
+	s.targets, s.adjusted = next, true
+	return nil
+}
+
+// Shift moves percent points of the split's traffic to the named target,
+// taking it from the others in proportion to their shares, and returns the
+// new shares. A target never goes below 0% or above 100%.
+func (s *Split) Shift(name string, percent float64) (map[string]float64, error) {
+	if math.IsNaN(percent) || math.IsInf(percent, 0) {
+		return nil, fmt.Errorf("invalid percentage %v", percent)
+	}
+	s.mu.Lock()
+	i := s.target(name)
+	if i < 0 {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("pool %q is not a target of split %s", name, s.name)
+	}
+	total := 0.0
+	for _, t := range s.targets {
+		total += t.weight
+	}
+	share := s.targets[i].weight / total * 100
+	goal := math.Max(0, math.Min(100, share+percent))
+	rest := 100 - share
+	next := make([]splitTarget, len(s.targets))
+	for j, t := range s.targets {
+		next[j] = t
+		switch {
+		case j == i:
+			next[j].weight = goal
+		case rest > 0:
+			next[j].weight = t.weight / total * 100 * (100 - goal) / rest
+		}
+	}
+	if rest == 0 && goal < 100 {
+		// The others all had 0%; split what the target gives up evenly.
+		for j := range next {
+			if j != i {
+				next[j].weight = (100 - goal) / float64(len(next)-1)
+			}
+		}
+	}
+	if len(next) == 1 {
+		next[i].weight = 100
+	}
+	s.targets, s.adjusted = next, true
+	s.mu.Unlock()
+	return s.Weights(), nil
+}
+
+func (s *Split) target(name string) int {
+	for i, t := range s.targets {
+		if t.pool.name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testSplit builds a split over new pools named after its targets.
+func testSplit(t *testing.T, sc *SplitConfig) *Split {
+	t.Helper()
+	pools := make(map[string]*Pool)
+	for _, target := range sc.Targets {
+		p, err := newPool(target.Pool, "round-robin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[target.Pool] = p
+	}
+	return buildSplits([]*SplitConfig{sc}, pools, nil)[sc.Name]
+}
+
+func splitTargets(weights ...float64) []SplitTarget {
+	targets := make([]SplitTarget, len(weights))
+	for i, w := range weights {
+		targets[i] = SplitTarget{Pool: string(rune('a' + i)), Weight: w}
+	}
+	return targets
+}
+
+func TestSplitShift(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []float64
+		shifts  []float64 // applied to pool a in turn
+		want    []float64 // percent, after the last shift
+	}{
+		{"up", []float64{10, 90}, []float64{20}, []float64{30, 70}},
+		{"down", []float64{30, 70}, []float64{-10}, []float64{20, 80}},
+		{"relative weights", []float64{1, 3}, []float64{25}, []float64{50, 50}},
+		{"others keep their proportions", []float64{50, 30, 20}, []float64{10}, []float64{60, 24, 16}},
+		{"clamped at 100", []float64{10, 90}, []float64{50, 50}, []float64{100, 0}},
+		{"clamped at 0", []float64{10, 90}, []float64{-25}, []float64{0, 100}},
+		{"step-wise rollout", []float64{0, 100}, []float64{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10}, []float64{100, 0}},
+		{"back from 100", []float64{100, 0, 0}, []float64{-30}, []float64{70, 15, 15}},
+		{"single target", []float64{1}, []float64{-50}, []float64{100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSplit(t, &SplitConfig{Name: "rollout", Targets: splitTargets(tt.weights...)})
+			var shares map[string]float64
+			for _, percent := range tt.shifts {
+				var err error
+				if shares, err = s.Shift("a", percent); err != nil {
+					t.Fatal(err)
+				}
+				sum := 0.0
+				for _, share := range shares {
+					if share < 0 || share > 100 {
+						t.Errorf("share %v out of range after shifting %v", share, percent)
+					}
+					sum += share
+				}
+				if math.Abs(sum-100) > 1e-9 {
+					t.Errorf("shares sum to %v after shifting %v, want 100", sum, percent)
+				}
+			}
+			for i, want := range tt.want {
+				name := string(rune('a' + i))
+				if math.Abs(shares[name]-want) > 1e-9 {
+					t.Errorf("pool %s: %v%%, want %v%% (shares %v)", name, shares[name], want, shares)
+				}
+			}
+			if !s.Adjusted() {
+				t.Error("split not marked as adjusted")
+			}
+		})
+	}
+}
+
+func TestSplitShiftErrors(t *testing.T) {
+	s := testSplit(t, &SplitConfig{Name: "rollout", Targets: splitTargets(50, 50)})
+	for _, percent := range []float64{math.NaN(), math.Inf(1)} {
+		if _, err := s.Shift("a", percent); err == nil {
+			t.Errorf("shifting %v: no error", percent)
+		}
+	}
+	if _, err := s.Shift("c", 10); err == nil {
+		t.Error("shifting to a pool outside the split: no error")
+	}
+	if s.Adjusted() {
+		t.Error("failed shifts marked the split as adjusted")
+	}
+}
+
+func TestSplitChoose(t *testing.T) {
+	s := testSplit(t, &SplitConfig{
+		Name:    "canary",
+		Targets: []SplitTarget{{Pool: "stable", Weight: 90}, {Pool: "canary", Weight: 10}},
+		Pins: []SplitPin{
+			{Header: "X-Canary", Value: "always", Pool: "canary"},
+			{Cookie: "track", Value: "stable", Pool: "stable"},
+		},
+	})
+	// Pins win even when the pinned pool gets no traffic by weight.
+	if err := s.SetWeights(map[string]float64{"canary": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := func(header, value string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Add(header, value)
+		return r
+	}
+	before := counterValue(splitRequestsTotal, "canary", "canary", "pin")
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{"header pin", pinned("X-Canary", "always"), "canary"},
+		{"cookie pin", pinned("Cookie", "track=stable"), "stable"},
+		{"other header value", pinned("X-Canary", "never"), "stable"},
+	} {
+		if got := s.choose(tt.r).name; got != tt.want {
+			t.Errorf("%s: chose %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	r := pinned("X-Canary", "never")
+	r.Header.Add("X-Canary", "always")
+	if got := s.choose(r).name; got != "canary" {
+		t.Errorf("any value of a repeated header pins: chose %s, want canary", got)
+	}
+	if got := counterValue(splitRequestsTotal, "canary", "canary", "pin") - before; got != 2 {
+		t.Errorf("canary pins counted %v times, want 2", got)
+	}
+
+	if err := s.SetWeights(map[string]float64{"canary": 10}); err != nil {
+		t.Fatal(err)
+	}
+	const n = 100000
+	stable := counterValue(splitRequestsTotal, "canary", "stable", "weight")
+	canary := counterValue(splitRequestsTotal, "canary", "canary", "weight")
+	picks := make(map[string]int)
+	for i := 0; i < n; i++ {
+		picks[s.choose(httptest.NewRequest("GET", "/", nil)).name]++
+	}
+	if got := float64(picks["canary"]) / n; math.Abs(got-0.1) > 0.01 {
+		t.Errorf("canary got %.3f of requests, want 0.100", got)
+	}
+	if got := counterValue(splitRequestsTotal, "canary", "stable", "weight") - stable; got != float64(picks["stable"]) {
+		t.Errorf("stable counted %v times, chosen %d times", got, picks["stable"])
+	}
+	if got := counterValue(splitRequestsTotal, "canary", "canary", "weight") - canary; got != float64(picks["canary"]) {
+		t.Errorf("canary counted %v times, chosen %d times", got, picks["canary"])
+	}
+}
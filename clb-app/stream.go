@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Streaming controls how upstream response bodies reach the client.
+type Streaming struct {
+	// FlushInterval is how often buffered output of responses with a known
+	// length is flushed. Zero leaves flushing to net/http. Event streams and
+	// responses of unknown length are always flushed after every write.
+	FlushInterval time.Duration `json:"flush_interval"`
+	// ResponseBufferLimit, if positive, makes the balancer read responses of
+	// up to this size completely before sending them, so an upstream failure
+	// mid-body becomes a clean 502 or a retry instead of a truncated
+	// response. Larger responses are streamed.
+	ResponseBufferLimit int64 `json:"response_buffer_limit"`
+}
+
+// applyEnv applies the STREAM_FLUSH_INTERVAL and RESPONSE_BUFFER_LIMIT
+// overrides.
+func (s *Streaming) applyEnv() error {
+	var err error
+	if s.FlushInterval, err = envTimeout("STREAM_FLUSH_INTERVAL", s.FlushInterval); err != nil {
+		return err
+	}
+	if s.ResponseBufferLimit, err = envSize("RESPONSE_BUFFER_LIMIT", s.ResponseBufferLimit); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Streaming) validate(v *validator, path string) {
+	if s.FlushInterval < 0 {
+		v.errorf(path+".flush_interval", "must not be negative")
+	}
+	if s.ResponseBufferLimit < 0 {
+		v.errorf(path+".response_buffer_limit", "must not be negative")
+	}
+}
+
+// flushInterval returns how often resp's body is flushed while copying it;
+// negative means after every write.
+func (s *Streaming) flushInterval(resp *http.Response) time.Duration {
+	if isEventStream(resp) || resp.ContentLength == -1 {
+		return -1
+	}
+	return s.FlushInterval
+}
+
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// bufferResponse reads up to ResponseBufferLimit bytes of resp's body into
+// memory. If the whole body fits, a read error is returned before anything
+// has been sent to the client; otherwise the rest of the body is streamed
+// after the buffered part.
+func (s *Streaming) bufferResponse(resp *http.Response) error {
+	if s.ResponseBufferLimit <= 0 || isEventStream(resp) || resp.ContentLength > s.ResponseBufferLimit {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, s.ResponseBufferLimit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > s.ResponseBufferLimit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	return nil
+}
+
+// deadlineWriter moves the connection's write deadline timeout ahead before
+// every write and flush of a response body, so that the server's write
+// timeout bounds each chunk rather than the whole response.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func newDeadlineWriter(w http.ResponseWriter, timeout time.Duration) http.ResponseWriter {
+	if timeout <= 0 {
+		return w
+	}
+	return &deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	return dw.ResponseWriter.Write(p)
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flushWriter flushes w after every write, or at most interval after the
+// first unflushed write.
+type flushWriter struct {
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+func newFlushWriter(w http.ResponseWriter, interval time.Duration) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok || interval == 0 {
+		return w
+	}
+	return &flushWriter{w: w, flusher: flusher, interval: interval}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.interval < 0 {
+		fw.flusher.Flush()
+		return n, nil
+	}
+	if !fw.pending {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.pending {
+		fw.flusher.Flush()
+		fw.pending = false
+	}
+}
+
+// stop cancels a pending delayed flush; it must be called before the handler
+// returns.
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
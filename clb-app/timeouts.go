@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts bounds how long the balancer waits on clients and backends. Zero
+// disables a timeout.
+//
+// Response bodies may take as long as the backend and client like, so that
+// event streams and large downloads are not cut off: once the headers
+// arrive, Upstream no longer applies, StreamIdle bounds each wait for the
+// next chunk instead, and Write bounds each write to the client rather than
+// the whole response.
+type Timeouts struct {
+	// Listening server.
+	ReadHeader time.Duration `json:"read_header"`
+	Read       time.Duration `json:"read"`
+	Write      time.Duration `json:"write"`
+	Idle       time.Duration `json:"idle"`
+
+	// Upstream transport.
+	Dial           time.Duration `json:"dial"`
+	TLSHandshake   time.Duration `json:"tls_handshake"`
+	ResponseHeader time.Duration `json:"response_header"`
+	Upstream       time.Duration `json:"upstream"`    // until the response headers, retries included
+	StreamIdle     time.Duration `json:"stream_idle"` // longest silence of a response body
+}
+
+// applyEnv applies the SERVER_*_TIMEOUT and UPSTREAM_*_TIMEOUT overrides, where
+// "0" disables a timeout.
+func (t *Timeouts) applyEnv() error {
+	for _, s := range []struct {
+		dst *time.Duration
+		key string
+	}{
+		{&t.ReadHeader, "SERVER_READ_HEADER_TIMEOUT"},
+		{&t.Read, "SERVER_READ_TIMEOUT"},
+		{&t.Write, "SERVER_WRITE_TIMEOUT"},
+		{&t.Idle, "SERVER_IDLE_TIMEOUT"},
+		{&t.Dial, "UPSTREAM_DIAL_TIMEOUT"},
+		{&t.TLSHandshake, "UPSTREAM_TLS_HANDSHAKE_TIMEOUT"},
+		{&t.ResponseHeader, "UPSTREAM_RESPONSE_HEADER_TIMEOUT"},
+		{&t.Upstream, "UPSTREAM_TIMEOUT"},
+		{&t.StreamIdle, "UPSTREAM_STREAM_IDLE_TIMEOUT"},
+	} {
+		d, err := envTimeout(s.key, *s.dst)
+		if err != nil {
+			return err
+		}
+		*s.dst = d
+	}
+	return nil
+}
+
+func (t *Timeouts) validate(v *validator, path string) {
+	for name, d := range map[string]time.Duration{
+		"read_header":     t.ReadHeader,
+		"read":            t.Read,
+		"write":           t.Write,
+		"idle":            t.Idle,
+		"dial":            t.Dial,
+		"tls_handshake":   t.TLSHandshake,
+		"response_header": t.ResponseHeader,
+		"upstream":        t.Upstream,
+		"stream_idle":     t.StreamIdle,
+	} {
+		if d < 0 {
+			v.errorf(path+"."+name, "must not be negative")
+		}
+	}
+}
+
+func (t *Timeouts) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: t.ReadHeader,
+		ReadTimeout:       t.Read,
+		WriteTimeout:      t.Write,
+		IdleTimeout:       t.Idle,
+	}
+}
+
+func (t *Timeouts) newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   t.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   t.TLSHandshake,
+		ResponseHeaderTimeout: t.ResponseHeader,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+	}
+}
+
+// exchangeTimeout enforces Upstream on a proxied exchange by cancelling its
+// context, which ends the request to the backend and the copy of its response.
+type exchangeTimeout struct {
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32 // accessed atomically
+}
+
+func (t *Timeouts) startExchange(cancel context.CancelFunc) *exchangeTimeout {
+	et := &exchangeTimeout{cancel: cancel}
+	if t.Upstream > 0 {
+		et.timer = time.AfterFunc(t.Upstream, et.expire)
+	}
+	return et
+}
+
+func (et *exchangeTimeout) expire() {
+	atomic.StoreInt32(&et.expired, 1)
+	et.cancel()
+}
+
+// Expired reports whether the exchange was cancelled for taking too long.
+func (et *exchangeTimeout) Expired() bool {
+	return atomic.LoadInt32(&et.expired) == 1
+}
+
+// stream lifts the Upstream timeout once the response headers have arrived
+// and returns the body, wrapped to cancel the exchange if a read waits longer
+// than idle.
+func (et *exchangeTimeout) stream(body io.ReadCloser, idle time.Duration) io.ReadCloser {
+	et.stop()
+	if idle <= 0 {
+		return body
+	}
+	et.timer = time.AfterFunc(idle, et.expire)
+	et.timer.Stop()
+	return &idleReader{ReadCloser: body, timer: et.timer, idle: idle}
+}
+
+func (et *exchangeTimeout) stop() {
+	if et.timer != nil {
+		et.timer.Stop()
+	}
+}
+
+// idleReader runs timer while a read is blocked, so that only time spent
+// waiting on the backend counts, not time spent writing to the client.
+type idleReader struct {
+	io.ReadCloser
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.idle)
+	n, err := r.ReadCloser.Read(p)
+	r.timer.Stop()
+	return n, err
+}
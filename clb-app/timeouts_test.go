@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTimeoutsSpareSlowBodies proxies responses through a server with the
+// configured write timeout: bodies may take longer than the upstream and
+// write timeouts as long as no chunk is late, while slow headers and stalled
+// bodies are still cut off.
+func TestTimeoutsSpareSlowBodies(t *testing.T) {
+	const chunk = "0123456789"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		headerDelay, _ := time.ParseDuration(q.Get("header_delay"))
+		gap, _ := time.ParseDuration(q.Get("gap"))
+		chunks, _ := strconv.Atoi(q.Get("chunks"))
+		time.Sleep(headerDelay)
+		if q.Get("length") != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(chunks*len(chunk)))
+		}
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < chunks; i++ {
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(gap):
+			case <-r.Context().Done():
+				return
+			}
+			io.WriteString(w, chunk)
+		}
+	}))
+	defer backend.Close()
+	setupTestProxy(t, fmt.Sprintf(`
+pools:
+  - name: web
+    backends:
+      - address: %s
+timeouts:
+  upstream: 300ms
+  write: 500ms
+  stream_idle: 300ms
+access_log:
+  output: "off"
+`, strings.TrimPrefix(backend.URL, "http://")))
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(loadBalance))
+	proxy.Config.WriteTimeout = timeouts.Write
+	proxy.Start()
+	defer proxy.Close()
+
+	tests := []struct {
+		name, query string
+		status      int
+		complete    bool
+	}{
+		{"slow body with known length", "chunks=10&gap=100ms&length=1", http.StatusOK, true},
+		{"slow body of unknown length", "chunks=10&gap=100ms", http.StatusOK, true},
+		// Cut off before the first chunk, so the headers may not be out yet.
+		{"stalled body", "chunks=2&gap=1s&length=1", 0, false},
+		{"slow headers", "header_delay=1s", http.StatusGatewayTimeout, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(proxy.URL + "/?" + tt.query)
+			var body []byte
+			if err == nil {
+				defer resp.Body.Close()
+				if tt.status != 0 && resp.StatusCode != tt.status {
+					t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+				}
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+				body, err = io.ReadAll(resp.Body)
+			} else if tt.status != 0 {
+				t.Fatal(err)
+			}
+			if complete := err == nil && len(body) == 10*len(chunk); complete != tt.complete {
+				t.Errorf("got %d bytes, error %v; want complete %v", len(body), err, tt.complete)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracing configures W3C trace context propagation and OTLP span export.
+// Without an endpoint no spans are recorded and traceparent headers are passed
+// through untouched.
+type Tracing struct {
+	Endpoint    string  `json:"endpoint"` // OTLP/HTTP collector base URL, e.g. http://otel-collector:4318
+	ServiceName string  `json:"service_name"`
+	SampleRate  float64 `json:"sample_rate"` // for traces started here; an incoming sampled flag is honored
+}
+
+func (tc *Tracing) setDefaults() {
+	tc.ServiceName = "clb-app"
+	tc.SampleRate = 1
+}
+
+// applyEnv applies the standard OTEL_EXPORTER_OTLP_ENDPOINT and
+// OTEL_SERVICE_NAME variables and TRACE_SAMPLE_RATE.
+func (tc *Tracing) applyEnv() error {
+	tc.Endpoint = envOr("OTEL_EXPORTER_OTLP_ENDPOINT", tc.Endpoint)
+	tc.ServiceName = envOr("OTEL_SERVICE_NAME", tc.ServiceName)
+	var err error
+	if tc.SampleRate, err = envFloat("TRACE_SAMPLE_RATE", tc.SampleRate); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (tc *Tracing) validate(v *validator, path string) {
+	if tc.Endpoint != "" {
+		if u, err := url.Parse(tc.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path+".endpoint", "must be an http or https URL, got %q", tc.Endpoint)
+		}
+	}
+	if tc.ServiceName == "" {
+		v.errorf(path+".service_name", "is required")
+	}
+	if tc.SampleRate < 0 || tc.SampleRate > 1 {
+		v.errorf(path+".sample_rate", "must be between 0 and 1, got %v", tc.SampleRate)
+	}
+}
+
+const traceparentHeader = "Traceparent"
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// Tracer records spans and exports them in batches to an OTLP/HTTP collector.
+// A nil *Tracer records nothing.
+type Tracer struct {
+	cfg    Tracing
+	client *http.Client
+	spans  chan *span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newTracer(cfg Tracing) *Tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan *span, 4096),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// span is one timed operation. A nil *span, as returned when tracing is off,
+// ignores every call.
+type span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	sampled  bool
+
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      []otlpAttribute
+	status     int
+	message    string
+}
+
+// startServerSpan starts the span for serving r, continuing the trace in its
+// traceparent header if it has a valid one.
+func (t *Tracer) startServerSpan(r *http.Request, name string) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+	if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, flags&1 == 1
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mathrand.Float64() < t.cfg.SampleRate
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child starts a span below s in the same trace.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, sampled: s.sampled,
+		name: name, kind: kind, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case int:
+		n := strconv.Itoa(v)
+		a.Value.IntValue = &n
+	case bool:
+		a.Value.BoolValue = &v
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		str := fmt.Sprint(v)
+		a.Value.StringValue = &str
+	}
+	s.attrs = append(s.attrs, a)
+}
+
+func (s *span) setError(message string) {
+	if s == nil {
+		return
+	}
+	s.status, s.message = spanStatusError, message
+}
+
+// traceparent is the header value that makes s the parent of the receiver's
+// spans.
+func (s *span) traceparent() string {
+	flags := 0
+	if s.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", s.traceID, s.spanID, flags)
+}
+
+// finish ends s and queues it for export if its trace is sampled. Spans are
+// dropped rather than delaying requests when the queue is full.
+func (s *span) finish() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, 0, false
+	}
+	var f [1]byte
+	if !decodeHex(traceID[:], parts[1]) || !decodeHex(parentID[:], parts[2]) || !decodeHex(f[:], parts[3]) {
+		return traceID, parentID, 0, false
+	}
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, 0, false
+	}
+	return traceID, parentID, f[0], true
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// run batches queued spans and exports them every few seconds, or sooner when
+// a batch fills up, until Close is called.
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// Close exports the spans still queued.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		log.Printf("trace export: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(t.cfg.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("trace export: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Printf("trace export: dropped %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("trace export: dropped %d spans: collector returned %s", len(batch), resp.Status)
+	}
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest, limited to the
+// fields the balancer sets.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	} `json:"value"`
+}
+
+func (t *Tracer) request(batch []*span) otlpRequest {
+	var rs otlpResourceSpans
+	host, _ := os.Hostname()
+	for _, kv := range [][2]string{{"service.name", t.cfg.ServiceName}, {"host.name", host}} {
+		a := otlpAttribute{Key: kv[0]}
+		v := kv[1]
+		a.Value.StringValue = &v
+		rs.Resource.Attributes = append(rs.Resource.Attributes, a)
+	}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "clb-app"
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parentID != ([8]byte{}) {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		out.Status.Code, out.Status.Message = s.status, s.message
+		ss.Spans = append(ss.Spans, out)
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
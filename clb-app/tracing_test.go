@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testCollector is an OTLP/HTTP collector that keeps the spans it receives.
+type testCollector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("collector got %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding export: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// span returns the one collected span named name.
+func (c *testCollector) span(t *testing.T, name string) otlpSpan {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found []otlpSpan
+	for _, s := range c.spans {
+		if s.Name == name {
+			found = append(found, s)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("collected %d %q spans, want 1", len(found), name)
+	}
+	return found[0]
+}
+
+func TestTracingSpans(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	collector := newTestCollector(t)
+	forwarded := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get(traceparentHeader)
+	}))
+	defer backend.Close()
+	setupTestProxy(t, fmt.Sprintf(`
+pools:
+  - name: web
+    backends:
+      - address: %s
+tracing:
+  endpoint: %s
+  sample_rate: 1
+access_log:
+  output: "off"
+`, strings.TrimPrefix(backend.URL, "http://"), collector.URL))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-01")
+	loadBalance(httptest.NewRecorder(), req)
+	tracer.Close()
+
+	server := collector.span(t, "proxy GET")
+	sel := collector.span(t, "select backend")
+	attempt := collector.span(t, "upstream attempt")
+	for _, s := range []otlpSpan{server, sel, attempt} {
+		if s.TraceID != traceID {
+			t.Errorf("%s span: trace ID %s, want the incoming %s", s.Name, s.TraceID, traceID)
+		}
+	}
+	if server.Kind != spanKindServer || server.ParentSpanID != parentID {
+		t.Errorf("server span: kind %d, parent %q; want kind %d below the caller's %s", server.Kind, server.ParentSpanID, spanKindServer, parentID)
+	}
+	if sel.Kind != spanKindInternal || sel.ParentSpanID != server.SpanID {
+		t.Errorf("select span: kind %d, parent %q; want kind %d below the server span %s", sel.Kind, sel.ParentSpanID, spanKindInternal, server.SpanID)
+	}
+	if attempt.Kind != spanKindClient || attempt.ParentSpanID != server.SpanID {
+		t.Errorf("attempt span: kind %d, parent %q; want kind %d below the server span %s", attempt.Kind, attempt.ParentSpanID, spanKindClient, server.SpanID)
+	}
+	if got, want := <-forwarded, "00-"+traceID+"-"+attempt.SpanID+"-01"; got != want {
+		t.Errorf("upstream traceparent %q, want %q naming the attempt span", got, want)
+	}
+}
@@ -16,6 +16,9 @@ func handler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	http.HandleFunc("/", handler)
+	if otlpEndpoint != "" {
+		go exportSpans()
+	}
+	http.HandleFunc("/", traced("handler", handler))
 	http.ListenAndServe(":80", nil)
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spans are exported to the OTLP/HTTP collector at OTEL_EXPORTER_OTLP_ENDPOINT
+// (e.g. http://otel-collector:4318); tracing is off when it is unset. The
+// trace is continued from the traceparent header set by clb-app, and only
+// sampled traces are recorded.
+var (
+	otlpEndpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/")
+	serviceName  = envOr("OTEL_SERVICE_NAME", "web-app")
+	traceClient  = &http.Client{Timeout: 10 * time.Second}
+	spans        = make(chan otlpSpan, 4096)
+)
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// traced wraps h in a server span continuing the caller's trace.
+func traced(name string, h http.HandlerFunc) http.HandlerFunc {
+	if otlpEndpoint == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("Traceparent"))
+		if !ok || !sampled {
+			h(w, r)
+			return
+		}
+		var spanID [8]byte
+		rand.Read(spanID[:])
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r)
+
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(traceID[:]),
+			SpanID:            hex.EncodeToString(spanID[:]),
+			ParentSpanID:      hex.EncodeToString(parentID[:]),
+			Name:              name,
+			Kind:              2, // server
+			StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+			Attributes: []otlpAttribute{
+				stringAttribute("http.method", r.Method),
+				stringAttribute("http.target", r.URL.RequestURI()),
+				stringAttribute("http.status_code", strconv.Itoa(sw.status)),
+			},
+		}
+		if sw.status >= 500 {
+			s.Status.Code = 2 // error
+		}
+		select {
+		case spans <- s:
+		default:
+		}
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// parseTraceparent parses a W3C traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, traceID != [16]byte{} && parentID != [8]byte{}
+}
+
+// exportSpans sends queued spans to the collector in batches every few
+// seconds.
+func exportSpans() {
+	for range time.Tick(5 * time.Second) {
+		exportQueued()
+	}
+}
+
+// exportQueued sends up to a batch of the queued spans to the collector.
+func exportQueued() {
+	var batch []otlpSpan
+	for len(spans) > 0 && len(batch) < 512 {
+		batch = append(batch, <-spans)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	host, _ := os.Hostname()
+	var req otlpRequest
+	req.ResourceSpans = make([]otlpResourceSpans, 1)
+	rs := &req.ResourceSpans[0]
+	rs.Resource.Attributes = []otlpAttribute{
+		stringAttribute("service.name", serviceName),
+		stringAttribute("host.name", host),
+	}
+	rs.ScopeSpans = make([]otlpScopeSpans, 1)
+	rs.ScopeSpans[0].Scope.Name = "web-app"
+	rs.ScopeSpans[0].Spans = batch
+
+	body, _ := json.Marshal(req)
+	resp, err := traceClient.Post(otlpEndpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("trace export: dropped %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("trace export: dropped %d spans: collector returned %s", len(batch), resp.Status)
+	}
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest, limited to the
+// fields web-app sets.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
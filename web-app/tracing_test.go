@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracedContinuesTrace(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	exports := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("collector got %s %s", r.Method, r.URL.Path)
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding export: %v", err)
+		}
+		exports <- req
+	}))
+	defer collector.Close()
+	defer func(endpoint string) { otlpEndpoint = endpoint }(otlpEndpoint)
+	otlpEndpoint = collector.URL
+
+	h := traced("handler", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, flags := range []string{"00", "01"} {
+		req := httptest.NewRequest("GET", "/hello?x=1", nil)
+		req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-"+flags)
+		h(httptest.NewRecorder(), req)
+	}
+	exportQueued()
+
+	req := <-exports
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export = %+v, want one resource with one scope", req)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0].Spans
+	// Only the sampled request is recorded.
+	if len(got) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(got))
+	}
+	s := got[0]
+	if s.TraceID != traceID || s.ParentSpanID != parentID || s.Kind != 2 || s.Name != "handler" {
+		t.Errorf("span %s %q: trace %s, parent %s, kind %d; want trace %s below %s, kind 2",
+			s.SpanID, s.Name, s.TraceID, s.ParentSpanID, s.Kind, traceID, parentID)
+	}
+	if len(s.SpanID) != 16 || s.SpanID == parentID {
+		t.Errorf("span ID %q, want a new 16-digit ID", s.SpanID)
+	}
+	attrs := make(map[string]string)
+	for _, a := range s.Attributes {
+		attrs[a.Key] = a.Value.StringValue
+	}
+	if attrs["http.method"] != "GET" || attrs["http.target"] != "/hello?x=1" || attrs["http.status_code"] != "418" {
+		t.Errorf("attributes = %v", attrs)
+	}
+}